@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gempir/go-twitch-irc/v2"
+)
+
+// -------------=========== ALERTS
+
+const (
+	alertSub      = "sub"
+	alertResub    = "resub"
+	alertSubGift  = "subgift"
+	alertMassGift = "submysterygift"
+	alertRaid     = "raid"
+	alertCheer    = "cheer"
+)
+
+// STAlert is a sub, raid or cheer, for clients to show as an alert.
+type STAlert struct {
+	Kind string `json:"kind"`
+	// UserName is who subbed, gifted, raided or cheered
+	UserName  string `json:"userName"`
+	Recipient string `json:"recipient,omitempty"`
+	// Amount is what the alert is measured in: months subbed for subs and
+	// resubs, gifts for gifts, viewers for raids and bits for cheers.
+	Amount int `json:"amount"`
+	// Tier is the sub plan: 1000, 2000, 3000 or Prime
+	Tier      string `json:"tier,omitempty"`
+	Message   string `json:"msg,omitempty"`
+	SystemMsg string `json:"systemMsg,omitempty"`
+}
+
+// STAutoShuffle shuffles a list whenever an alert of its kind comes in with at
+// least MinAmount, e.g. a raid of 10 or more viewers. Note that a mass gift is
+// followed by a subgift alert for every gift.
+type STAutoShuffle struct {
+	Kind      string `json:"kind"`
+	MinAmount int    `json:"minAmount"`
+	ListId    int64  `json:"listId"`
+}
+
+// userNoticeAlert turns a USERNOTICE into an alert. Returns false for notices
+// that aren't alerts, like announcements.
+func userNoticeAlert(msg twitch.UserNoticeMessage) (STAlert, bool) {
+	param := func(name string) string { return msg.MsgParams["msg-param-"+name] }
+	paramInt := func(name string) int {
+		value, _ := strconv.Atoi(param(name))
+		return value
+	}
+
+	alert := STAlert{
+		Kind:      msg.MsgID,
+		UserName:  msg.User.DisplayName,
+		Message:   msg.Message,
+		SystemMsg: msg.SystemMsg,
+	}
+
+	switch msg.MsgID {
+	case alertSub, alertResub:
+		alert.Amount = paramInt("cumulative-months")
+		if alert.Amount == 0 {
+			alert.Amount = 1
+		}
+		alert.Tier = param("sub-plan")
+	case alertSubGift, "anonsubgift":
+		alert.Kind = alertSubGift
+		alert.Recipient = param("recipient-display-name")
+		alert.Amount = 1
+		alert.Tier = param("sub-plan")
+	case alertMassGift, "anonsubmysterygift":
+		alert.Kind = alertMassGift
+		alert.Amount = paramInt("mass-gift-count")
+		alert.Tier = param("sub-plan")
+	case alertRaid:
+		alert.UserName = param("displayName")
+		alert.Amount = paramInt("viewerCount")
+	default:
+		return alert, false
+	}
+
+	return alert, true
+}
+
+func cheerAlert(msg twitch.PrivateMessage) STAlert {
+	return STAlert{
+		Kind:     alertCheer,
+		UserName: msg.User.DisplayName,
+		Amount:   msg.Bits,
+		Message:  msg.Message,
+	}
+}
+
+// autoShuffle runs the first rule the alert meets, if any.
+func autoShuffle(rules []STAutoShuffle, alert STAlert) {
+	for _, rule := range rules {
+		if rule.Kind != alert.Kind || alert.Amount < rule.MinAmount {
+			continue
+		}
+
+		dbAccessMutex.Lock()
+		result, err := shuffleList(int(rule.ListId), defaultShuffleOptions())
+		dbAccessMutex.Unlock()
+
+		if err != nil {
+			fmt.Printf("Auto-shuffle for %s's %s failed: %v\n", alert.UserName, alert.Kind, err)
+			return
+		}
+
+		broadcastShuffle(result)
+		chatAnnounce(fmt.Sprintf("%s's %s shuffled: %s", alert.UserName, alert.Kind,
+			gameDisplayName(result.Game)))
+		return
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// -------------============== CHAT BACKLOG
+
+const defaultBacklogSize = 50
+
+// defaultBacklogSeconds is how far back a new client is caught up when it
+// doesn't say. Zero means as far back as the backlog goes.
+var defaultBacklogSeconds = 0
+
+// chatRing is a fixed-size ring buffer of chat messages, oldest first.
+type chatRing struct {
+	msgs  []TwitchWSMsg
+	start int
+	count int
+}
+
+func newChatRing(size int) *chatRing {
+	return &chatRing{msgs: make([]TwitchWSMsg, size)}
+}
+
+// push adds a message, overwriting the oldest one if the ring is full.
+func (r *chatRing) push(msg TwitchWSMsg) {
+	if r.count < len(r.msgs) {
+		r.msgs[(r.start+r.count)%len(r.msgs)] = msg
+		r.count++
+	} else {
+		r.msgs[r.start] = msg
+		r.start = (r.start + 1) % len(r.msgs)
+	}
+}
+
+// list returns the buffered messages, oldest first.
+func (r *chatRing) list() []TwitchWSMsg {
+	msgs := make([]TwitchWSMsg, r.count)
+	for x := range msgs {
+		msgs[x] = r.msgs[(r.start+x)%len(r.msgs)]
+	}
+	return msgs
+}
+
+// removeIf drops every buffered message that matches.
+func (r *chatRing) removeIf(match func(TwitchWSMsg) bool) {
+	msgs := r.list()
+	r.start, r.count = 0, 0
+	for _, msg := range msgs {
+		if !match(msg) {
+			r.push(msg)
+		}
+	}
+}
+
+// chatBacklog keeps the most recent chat messages of each channel, so new
+// clients can be caught up. It isn't safe for concurrent use; the hub guards
+// it.
+type chatBacklog struct {
+	size     int
+	channels map[string]*chatRing
+}
+
+// backlogReplay says how much of the backlog a new client wants. Zero means no
+// limit.
+type backlogReplay struct {
+	limit   int
+	seconds int
+}
+
+func newChatBacklog(size int) *chatBacklog {
+	return &chatBacklog{size: size, channels: map[string]*chatRing{}}
+}
+
+// record buffers chat messages and takes back out whatever moderators remove.
+func (b *chatBacklog) record(msg TwitchWSMsg) {
+	if b.size <= 0 || msg.Channel == "" {
+		return
+	}
+	channel := normalizeChannel(msg.Channel)
+
+	switch msg.MsgType {
+	case msgTypeMessage, msgTypeAction:
+		ring, ok := b.channels[channel]
+		if !ok {
+			ring = newChatRing(b.size)
+			b.channels[channel] = ring
+		}
+		ring.push(msg)
+	case msgTypeDelete:
+		if ring, ok := b.channels[channel]; ok {
+			ring.removeIf(func(buffered TwitchWSMsg) bool { return buffered.Id == msg.Id })
+		}
+	case msgTypePurge:
+		if ring, ok := b.channels[channel]; ok {
+			ring.removeIf(func(buffered TwitchWSMsg) bool { return buffered.UserId == msg.UserId })
+		}
+	case msgTypeClear:
+		delete(b.channels, channel)
+	}
+}
+
+// replay returns the buffered messages a client subscribes to, oldest first.
+func (b *chatBacklog) replay(subs *TwitchWSSubscription, opts backlogReplay) []TwitchWSMsg {
+	var since int64
+	if opts.seconds > 0 {
+		since = time.Now().Add(-time.Duration(opts.seconds) * time.Second).Unix()
+	}
+
+	var msgs []TwitchWSMsg
+	for _, ring := range b.channels {
+		for _, msg := range ring.list() {
+			if msg.Time >= since && subs.wants(msg) {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Time < msgs[j].Time })
+	if opts.limit > 0 && len(msgs) > opts.limit {
+		msgs = msgs[len(msgs)-opts.limit:]
+	}
+	return msgs
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gempir/go-twitch-irc/v2"
+)
+
+// -------------=========== CHAT COMMANDS
+
+// defaultCommandBadges are the badges allowed to use chat commands when
+// stconfig.json doesn't say otherwise.
+var defaultCommandBadges = []string{"broadcaster", "moderator", "vip"}
+
+type chatCommand func(msg twitch.PrivateMessage, args []string)
+
+var chatCommands = map[string]chatCommand{
+	"!shuffle":  commandShuffle,
+	"!lists":    commandLists,
+	"!current":  commandCurrent,
+	"!markdone": commandMarkDone,
+}
+
+// twitchClient is the connection to Twitch chat. It can only speak in chat if
+// twitchCanSpeak is set, i.e. a bot account is configured.
+var twitchClient *twitch.Client
+var twitchCanSpeak bool
+
+// chatChannels are the channels joined on Twitch.
+var chatChannels []string
+
+// chatReply says something in a channel's chat. It only goes to the log when
+// there's no bot account to speak with.
+func chatReply(channel string, text string) {
+	fmt.Printf("[%s] reply: %s\n", channel, text)
+	if twitchCanSpeak {
+		twitchClient.Say(channel, text)
+	}
+}
+
+// chatAnnounce says something in every joined channel's chat.
+func chatAnnounce(text string) {
+	for _, channel := range chatChannels {
+		chatReply(channel, text)
+	}
+}
+
+// canUseCommands checks whether the sender has one of the badges allowed to
+// use chat commands.
+func canUseCommands(user twitch.User, allowedBadges []string) bool {
+	for _, badge := range allowedBadges {
+		if _, ok := user.Badges[badge]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// handleChatCommand runs the chat command in a message, if it has one and the
+// sender is allowed to use it. Returns whether the message was a command.
+func handleChatCommand(msg twitch.PrivateMessage, allowedBadges []string) bool {
+	args := strings.Fields(msg.Message)
+	if len(args) == 0 {
+		return false
+	}
+
+	command, ok := chatCommands[strings.ToLower(args[0])]
+	if !ok {
+		return false
+	}
+
+	if !canUseCommands(msg.User, allowedBadges) {
+		fmt.Printf("[%s] %s isn't allowed to use %s\n", msg.Channel, msg.User.DisplayName, args[0])
+		return true
+	}
+
+	fmt.Printf("[%s] %s used %s\n", msg.Channel, msg.User.DisplayName, args[0])
+	command(msg, args[1:])
+	return true
+}
+
+// findListId looks up a list by its ID or, failing that, its name. The caller
+// must hold dbAccessMutex.
+func findListId(nameOrId string) (int, error) {
+	stmt := `SELECT listId FROM lists WHERE listId = ? OR listName = ? COLLATE NOCASE ORDER BY listId = ? DESC`
+
+	var listId int
+	if err := db.QueryRow(stmt, nameOrId, nameOrId, nameOrId).Scan(&listId); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, &apiError{fmt.Sprintf("List not found: %s", nameOrId), http.StatusNotFound}
+		}
+		fmt.Printf("%q: during exec %s\n", err, stmt)
+		return 0, fmt.Errorf("Error during exec: %q", err)
+	}
+	return listId, nil
+}
+
+// currentGame returns the game picked by the most recent shuffle. The caller
+// must hold dbAccessMutex.
+func currentGame() (STGame, error) {
+	stmt := `
+		SELECT g.* FROM shuffle_history h
+		JOIN games g ON g.gameId = h.gameId
+		ORDER BY h.historyId DESC
+		LIMIT 1
+	`
+
+	var game STGame
+	var activeDisplayName string
+	if err := db.QueryRow(stmt).Scan(&game.Id, &game.ListId, &game.Name, &game.DisplayName,
+		&game.Description, &game.Weight, &game.Status, &activeDisplayName); err != nil {
+		if err == sql.ErrNoRows {
+			return game, &apiError{"Nothing has been shuffled yet", http.StatusNotFound}
+		}
+		fmt.Printf("%q: during exec %s\n", err, stmt)
+		return game, fmt.Errorf("Error during exec: %q", err)
+	}
+	return game, nil
+}
+
+func gameDisplayName(game STGame) string {
+	if displayName := game.DisplayName.Get(); displayName != nil {
+		return *displayName
+	}
+	return game.Name
+}
+
+func commandShuffle(msg twitch.PrivateMessage, args []string) {
+	if len(args) == 0 {
+		chatReply(msg.Channel, "Usage: !shuffle <list>")
+		return
+	}
+
+	dbAccessMutex.Lock()
+	listId, err := findListId(strings.Join(args, " "))
+	var result ShuffleResult
+	if err == nil {
+		result, err = shuffleList(listId, defaultShuffleOptions())
+	}
+	dbAccessMutex.Unlock()
+
+	if err != nil {
+		chatReply(msg.Channel, "Shuffle failed: "+err.Error())
+		return
+	}
+
+	broadcastShuffle(result)
+	chatReply(msg.Channel, fmt.Sprintf("Shuffled: %s", gameDisplayName(result.Game)))
+}
+
+func commandLists(msg twitch.PrivateMessage, args []string) {
+	stmt := `SELECT * FROM lists ORDER BY listId`
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	rows, err := db.Query(stmt)
+	if err != nil {
+		fmt.Printf("%q: during query %s\n", err, stmt)
+		chatReply(msg.Channel, "Couldn't get lists")
+		return
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var list STList
+		if err := rows.Scan(&list.Id, &list.Name); err != nil {
+			fmt.Printf("%q: during exec %s\n", err, stmt)
+		}
+		names = append(names, strconv.FormatInt(list.Id, 10)+": "+list.Name)
+	}
+
+	if err = rows.Err(); err != nil {
+		fmt.Printf("%q: after exec %s\n", err, stmt)
+	}
+
+	if len(names) == 0 {
+		chatReply(msg.Channel, "There are no lists")
+	} else {
+		chatReply(msg.Channel, "Lists: "+strings.Join(names, ", "))
+	}
+}
+
+func commandCurrent(msg twitch.PrivateMessage, args []string) {
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	if game, err := currentGame(); err != nil {
+		chatReply(msg.Channel, err.Error())
+	} else {
+		chatReply(msg.Channel, "Current game: "+gameDisplayName(game))
+	}
+}
+
+func commandMarkDone(msg twitch.PrivateMessage, args []string) {
+	stmt := `UPDATE games SET status = status | ? WHERE gameId = ?`
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	game, err := currentGame()
+	if err != nil {
+		chatReply(msg.Channel, err.Error())
+		return
+	}
+
+	if _, err := db.Exec(stmt, flagPlayed, game.Id); err != nil {
+		fmt.Printf("%q: during exec %s\n", err, stmt)
+		chatReply(msg.Channel, "Couldn't mark "+gameDisplayName(game)+" as played")
+	} else {
+		chatReply(msg.Channel, "Marked "+gameDisplayName(game)+" as played")
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------=========== THIRD-PARTY EMOTES
+
+const (
+	defaultBttvUrl       = "https://api.betterttv.net/3"
+	defaultFfzUrl        = "https://api.frankerfacez.com/v1"
+	defaultSevenTvUrl    = "https://7tv.io/v3"
+	defaultEmoteCacheDir = "./emotecache"
+	defaultEmoteRefresh  = 60
+
+	emoteProviderBttv    = "bttv"
+	emoteProviderFfz     = "ffz"
+	emoteProviderSevenTv = "7tv"
+
+	emoteScopeGlobal     = "global"
+	emoteProviderTimeout = 10 * time.Second
+)
+
+var defaultEmoteProviders = []string{emoteProviderSevenTv, emoteProviderBttv, emoteProviderFfz}
+
+// errNoEmoteSet is returned when a provider doesn't know a channel, which just
+// means it has no emotes there.
+var errNoEmoteSet = errors.New("no emote set")
+
+var emoteClient = &http.Client{Timeout: emoteProviderTimeout}
+
+// STEmoteConfig turns on BTTV, FFZ and 7TV emotes. The URLs can be pointed at
+// a local stand-in for the providers' APIs for testing.
+type STEmoteConfig struct {
+	// Providers are the emote providers to use. When two have an emote of the
+	// same name, the one listed first wins.
+	Providers  []string `json:"providers,omitempty"`
+	BttvUrl    string   `json:"bttvUrl,omitempty"`
+	FfzUrl     string   `json:"ffzUrl,omitempty"`
+	SevenTvUrl string   `json:"sevenTvUrl,omitempty"`
+	// CacheDir is where emote sets are kept, so they're there straight away
+	// on startup and when a provider is down.
+	CacheDir string `json:"cacheDir,omitempty"`
+	// RefreshMinutes is how often emote sets are fetched again.
+	RefreshMinutes int `json:"refreshMinutes,omitempty"`
+}
+
+// thirdPartyEmote is an emote from BTTV, FFZ or 7TV.
+type thirdPartyEmote struct {
+	Provider string `json:"provider"`
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Url      string `json:"url"`
+}
+
+// emoteSetFetcher gets a provider's emote set. An empty room ID means the
+// provider's global set.
+type emoteSetFetcher func(baseUrl string, roomId string) ([]thirdPartyEmote, error)
+
+var emoteSetFetchers = map[string]emoteSetFetcher{
+	emoteProviderBttv:    fetchBttvEmotes,
+	emoteProviderFfz:     fetchFfzEmotes,
+	emoteProviderSevenTv: fetchSevenTvEmotes,
+}
+
+// emoteResolver finds third-party emotes in chat messages. Sets are keyed by
+// scope, which is either emoteScopeGlobal or a channel's room ID, and then by
+// provider.
+type emoteResolver struct {
+	config STEmoteConfig
+	mutex  sync.RWMutex
+	sets   map[string]map[string][]thirdPartyEmote
+	// names is the merged lookup for each scope, rebuilt whenever one of its
+	// sets changes
+	names map[string]map[string]thirdPartyEmote
+}
+
+// thirdPartyEmotes resolves BTTV, FFZ and 7TV emotes; it's nil when they're
+// turned off.
+var thirdPartyEmotes *emoteResolver
+
+func newEmoteResolver(config STEmoteConfig) *emoteResolver {
+	if err := os.MkdirAll(config.CacheDir, 0755); err != nil {
+		fmt.Printf("Couldn't make emote cache dir: %v\n", err)
+	}
+	return &emoteResolver{
+		config: config,
+		sets:   map[string]map[string][]thirdPartyEmote{},
+		names:  map[string]map[string]thirdPartyEmote{},
+	}
+}
+
+func (config STEmoteConfig) providerUrl(provider string) string {
+	switch provider {
+	case emoteProviderBttv:
+		return config.BttvUrl
+	case emoteProviderFfz:
+		return config.FfzUrl
+	case emoteProviderSevenTv:
+		return config.SevenTvUrl
+	}
+	return ""
+}
+
+func (r *emoteResolver) cachePath(provider string, scope string) string {
+	return filepath.Join(r.config.CacheDir, provider+"-"+scope+".json")
+}
+
+// readCache loads a scope's sets from disk, for any that haven't been fetched
+// yet.
+func (r *emoteResolver) readCache(scope string) {
+	for _, provider := range r.config.Providers {
+		file, err := os.ReadFile(r.cachePath(provider, scope))
+		if err != nil {
+			continue
+		}
+		var set []thirdPartyEmote
+		if err := json.Unmarshal(file, &set); err != nil {
+			fmt.Printf("Bad emote cache %s: %v\n", r.cachePath(provider, scope), err)
+			continue
+		}
+
+		r.mutex.Lock()
+		if _, ok := r.sets[scope][provider]; !ok {
+			r.store(scope, provider, set)
+		}
+		r.mutex.Unlock()
+	}
+}
+
+// fetch gets a scope's sets from the providers and caches them on disk. A set
+// that can't be fetched keeps whatever it had before.
+func (r *emoteResolver) fetch(scope string) {
+	roomId := scope
+	if scope == emoteScopeGlobal {
+		roomId = ""
+	}
+
+	for _, provider := range r.config.Providers {
+		set, err := emoteSetFetchers[provider](r.config.providerUrl(provider), roomId)
+		if err == errNoEmoteSet {
+			set, err = []thirdPartyEmote{}, nil
+		}
+		if err != nil {
+			fmt.Printf("Couldn't get %s emotes for %s: %v\n", provider, scope, err)
+			continue
+		}
+
+		r.mutex.Lock()
+		r.store(scope, provider, set)
+		r.mutex.Unlock()
+
+		if out, err := json.Marshal(set); err == nil {
+			if err := os.WriteFile(r.cachePath(provider, scope), out, 0644); err != nil {
+				fmt.Printf("Couldn't cache %s emotes for %s: %v\n", provider, scope, err)
+			}
+		}
+	}
+}
+
+// store swaps in a set and rebuilds the scope's lookup. The caller must hold
+// the write lock.
+func (r *emoteResolver) store(scope string, provider string, set []thirdPartyEmote) {
+	if r.sets[scope] == nil {
+		r.sets[scope] = map[string][]thirdPartyEmote{}
+	}
+	r.sets[scope][provider] = set
+
+	names := map[string]thirdPartyEmote{}
+	// go through the providers last to first so the first listed wins
+	for x := len(r.config.Providers) - 1; x >= 0; x-- {
+		for _, emote := range r.sets[scope][r.config.Providers[x]] {
+			names[emote.Name] = emote
+		}
+	}
+	r.names[scope] = names
+}
+
+// watchChannel starts picking up a channel's emotes the first time it's seen.
+func (r *emoteResolver) watchChannel(roomId string) {
+	r.mutex.Lock()
+	_, known := r.sets[roomId]
+	if !known {
+		r.sets[roomId] = map[string][]thirdPartyEmote{}
+	}
+	r.mutex.Unlock()
+
+	if !known {
+		r.readCache(roomId)
+		go r.fetch(roomId)
+	}
+}
+
+// refresher loads the global sets, then keeps every set seen so far fresh.
+func (r *emoteResolver) refresher() {
+	r.readCache(emoteScopeGlobal)
+	r.fetch(emoteScopeGlobal)
+
+	ticker := time.NewTicker(time.Duration(r.config.RefreshMinutes) * time.Minute)
+	for range ticker.C {
+		r.mutex.RLock()
+		var scopes []string
+		for scope := range r.sets {
+			scopes = append(scopes, scope)
+		}
+		r.mutex.RUnlock()
+
+		for _, scope := range scopes {
+			r.fetch(scope)
+		}
+	}
+}
+
+// annotate adds the third-party emotes in a message to its Twitch emotes.
+// Channel emotes win over global ones, and words already covered by a Twitch
+// emote are left alone. Positions are counted in code points, like Twitch's.
+func (r *emoteResolver) annotate(roomId string, message string, twitchEmotes []TwitchWSMsgEmote) []TwitchWSMsgEmote {
+	if r == nil {
+		return twitchEmotes
+	}
+	if roomId != "" {
+		r.watchChannel(roomId)
+	}
+
+	taken := map[int]bool{}
+	for _, emote := range twitchEmotes {
+		for _, pos := range emote.Positions {
+			taken[pos.Start] = true
+		}
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	found := map[string]int{}
+	outEmotes := twitchEmotes
+	start := 0
+	for _, word := range strings.Split(message, " ") {
+		length := len([]rune(word))
+		if length > 0 && !taken[start] {
+			emote, ok := r.names[roomId][word]
+			if !ok {
+				emote, ok = r.names[emoteScopeGlobal][word]
+			}
+			if ok {
+				pos := TwitchWSMsgEmotePos{start, start + length - 1}
+				key := emote.Provider + "/" + emote.Id
+				if x, seen := found[key]; seen {
+					outEmotes[x].Positions = append(outEmotes[x].Positions, pos)
+				} else {
+					found[key] = len(outEmotes)
+					outEmotes = append(outEmotes, TwitchWSMsgEmote{
+						Name:      emote.Name,
+						Id:        emote.Id,
+						Provider:  emote.Provider,
+						Url:       emote.Url,
+						Positions: []TwitchWSMsgEmotePos{pos},
+					})
+				}
+			}
+		}
+		start += length + 1
+	}
+
+	return outEmotes
+}
+
+func getJson(url string, out interface{}) error {
+	resp, err := emoteClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNoEmoteSet
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type bttvEmote struct {
+	Id   string `json:"id"`
+	Code string `json:"code"`
+}
+
+func fetchBttvEmotes(baseUrl string, roomId string) ([]thirdPartyEmote, error) {
+	var inEmotes []bttvEmote
+	if roomId == "" {
+		if err := getJson(baseUrl+"/cached/emotes/global", &inEmotes); err != nil {
+			return nil, err
+		}
+	} else {
+		var user struct {
+			ChannelEmotes []bttvEmote `json:"channelEmotes"`
+			SharedEmotes  []bttvEmote `json:"sharedEmotes"`
+		}
+		if err := getJson(baseUrl+"/cached/users/twitch/"+roomId, &user); err != nil {
+			return nil, err
+		}
+		inEmotes = append(user.ChannelEmotes, user.SharedEmotes...)
+	}
+
+	set := []thirdPartyEmote{}
+	for _, inEmote := range inEmotes {
+		set = append(set, thirdPartyEmote{
+			Provider: emoteProviderBttv,
+			Id:       inEmote.Id,
+			Name:     inEmote.Code,
+			Url:      "https://cdn.betterttv.net/emote/" + inEmote.Id + "/1x",
+		})
+	}
+	return set, nil
+}
+
+func fetchFfzEmotes(baseUrl string, roomId string) ([]thirdPartyEmote, error) {
+	var sets struct {
+		DefaultSets []int `json:"default_sets"`
+		Sets        map[string]struct {
+			Emoticons []struct {
+				Id   int               `json:"id"`
+				Name string            `json:"name"`
+				Urls map[string]string `json:"urls"`
+			} `json:"emoticons"`
+		} `json:"sets"`
+	}
+
+	url := baseUrl + "/set/global"
+	if roomId != "" {
+		url = baseUrl + "/room/id/" + roomId
+	}
+	if err := getJson(url, &sets); err != nil {
+		return nil, err
+	}
+
+	// the global endpoint also lists sets that are only for some users
+	wanted := map[string]bool{}
+	for _, setId := range sets.DefaultSets {
+		wanted[fmt.Sprint(setId)] = true
+	}
+
+	set := []thirdPartyEmote{}
+	for setId, inSet := range sets.Sets {
+		if roomId == "" && !wanted[setId] {
+			continue
+		}
+		for _, inEmote := range inSet.Emoticons {
+			url := inEmote.Urls["1"]
+			if strings.HasPrefix(url, "//") {
+				url = "https:" + url
+			}
+			set = append(set, thirdPartyEmote{
+				Provider: emoteProviderFfz,
+				Id:       fmt.Sprint(inEmote.Id),
+				Name:     inEmote.Name,
+				Url:      url,
+			})
+		}
+	}
+	return set, nil
+}
+
+type sevenTvEmoteSet struct {
+	Emotes []struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+		Data struct {
+			Host struct {
+				Url string `json:"url"`
+			} `json:"host"`
+		} `json:"data"`
+	} `json:"emotes"`
+}
+
+func fetchSevenTvEmotes(baseUrl string, roomId string) ([]thirdPartyEmote, error) {
+	var inSet sevenTvEmoteSet
+	if roomId == "" {
+		if err := getJson(baseUrl+"/emote-sets/global", &inSet); err != nil {
+			return nil, err
+		}
+	} else {
+		var user struct {
+			EmoteSet *sevenTvEmoteSet `json:"emote_set"`
+		}
+		if err := getJson(baseUrl+"/users/twitch/"+roomId, &user); err != nil {
+			return nil, err
+		}
+		if user.EmoteSet != nil {
+			inSet = *user.EmoteSet
+		}
+	}
+
+	set := []thirdPartyEmote{}
+	for _, inEmote := range inSet.Emotes {
+		url := inEmote.Data.Host.Url
+		if strings.HasPrefix(url, "//") {
+			url = "https:" + url
+		}
+		set = append(set, thirdPartyEmote{
+			Provider: emoteProviderSevenTv,
+			Id:       inEmote.Id,
+			Name:     inEmote.Name,
+			Url:      url + "/1x.webp",
+		})
+	}
+	return set, nil
+}
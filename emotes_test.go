@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// emoteStandIn serves canned responses in the shape of the BTTV, FFZ and 7TV
+// APIs, under /bttv, /ffz and /7tv. Room 123 has emotes; anything else 404s.
+func emoteStandIn(t *testing.T) *httptest.Server {
+	t.Helper()
+	responses := map[string]string{
+		"/bttv/cached/emotes/global": `[{"id":"b1","code":"catJAM"},{"id":"b2","code":"monkaS"},{"id":"b5","code":"Kappa"}]`,
+		"/bttv/cached/users/twitch/123": `{"channelEmotes":[{"id":"b3","code":"chanEmote"}],` +
+			`"sharedEmotes":[{"id":"b4","code":"KEKW"}]}`,
+
+		"/ffz/set/global": `{"default_sets":[3],"sets":{` +
+			`"3":{"emoticons":[{"id":31,"name":"ZrehplaR","urls":{"1":"//cdn.frankerfacez.com/emote/31/1"}}]},` +
+			`"4":{"emoticons":[{"id":41,"name":"notDefault","urls":{"1":"//cdn.frankerfacez.com/emote/41/1"}}]}}}`,
+		"/ffz/room/id/123": `{"sets":{"9":{"emoticons":[` +
+			`{"id":91,"name":"ffzChan","urls":{"1":"https://cdn.frankerfacez.com/emote/91/1"}}]}}}`,
+
+		"/7tv/emote-sets/global": `{"emotes":[` +
+			`{"id":"s1","name":"catJAM","data":{"host":{"url":"//cdn.7tv.app/emote/s1"}}},` +
+			`{"id":"s2","name":"KEKW","data":{"host":{"url":"//cdn.7tv.app/emote/s2"}}}]}`,
+		"/7tv/users/twitch/123": `{"emote_set":{"emotes":[` +
+			`{"id":"s3","name":"sevenChan","data":{"host":{"url":"//cdn.7tv.app/emote/s3"}}}]}}`,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func emoteNames(set []thirdPartyEmote) map[string]thirdPartyEmote {
+	names := map[string]thirdPartyEmote{}
+	for _, emote := range set {
+		names[emote.Name] = emote
+	}
+	return names
+}
+
+func TestEmoteFetchers(t *testing.T) {
+	server := emoteStandIn(t)
+
+	tests := []struct {
+		provider string
+		roomId   string
+		want     map[string]string // name to URL
+	}{
+		{emoteProviderBttv, "", map[string]string{
+			"catJAM": "https://cdn.betterttv.net/emote/b1/1x",
+			"monkaS": "https://cdn.betterttv.net/emote/b2/1x",
+			"Kappa":  "https://cdn.betterttv.net/emote/b5/1x",
+		}},
+		{emoteProviderBttv, "123", map[string]string{
+			"chanEmote": "https://cdn.betterttv.net/emote/b3/1x",
+			"KEKW":      "https://cdn.betterttv.net/emote/b4/1x",
+		}},
+		{emoteProviderFfz, "", map[string]string{
+			"ZrehplaR": "https://cdn.frankerfacez.com/emote/31/1",
+		}},
+		{emoteProviderFfz, "123", map[string]string{
+			"ffzChan": "https://cdn.frankerfacez.com/emote/91/1",
+		}},
+		{emoteProviderSevenTv, "", map[string]string{
+			"catJAM": "https://cdn.7tv.app/emote/s1/1x.webp",
+			"KEKW":   "https://cdn.7tv.app/emote/s2/1x.webp",
+		}},
+		{emoteProviderSevenTv, "123", map[string]string{
+			"sevenChan": "https://cdn.7tv.app/emote/s3/1x.webp",
+		}},
+	}
+
+	for _, test := range tests {
+		set, err := emoteSetFetchers[test.provider](server.URL+"/"+test.provider, test.roomId)
+		if err != nil {
+			t.Errorf("%s %q: %v", test.provider, test.roomId, err)
+			continue
+		}
+		got := map[string]string{}
+		for name, emote := range emoteNames(set) {
+			if emote.Provider != test.provider {
+				t.Errorf("%s %q: %s has provider %q", test.provider, test.roomId, name, emote.Provider)
+			}
+			got[name] = emote.Url
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %q: got %v, want %v", test.provider, test.roomId, got, test.want)
+		}
+
+		// a channel the provider doesn't know about has no set
+		if _, err := emoteSetFetchers[test.provider](server.URL+"/"+test.provider, "404"); err != errNoEmoteSet {
+			t.Errorf("%s: unknown channel gave %v, want errNoEmoteSet", test.provider, err)
+		}
+	}
+}
+
+// emotePositions flattens annotated emotes to "provider/name@start-end" so
+// they're easy to compare.
+func emotePositions(emotes []TwitchWSMsgEmote) []string {
+	var out []string
+	for _, emote := range emotes {
+		provider := emote.Provider
+		if provider == "" {
+			provider = "twitch"
+		}
+		for _, pos := range emote.Positions {
+			out = append(out, fmt.Sprintf("%s/%s@%d-%d", provider, emote.Id, pos.Start, pos.End))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestEmoteAnnotate(t *testing.T) {
+	server := emoteStandIn(t)
+	config := STEmoteConfig{
+		Providers:  []string{emoteProviderSevenTv, emoteProviderBttv, emoteProviderFfz},
+		BttvUrl:    server.URL + "/bttv",
+		FfzUrl:     server.URL + "/ffz",
+		SevenTvUrl: server.URL + "/7tv",
+		CacheDir:   t.TempDir(),
+	}
+	r := newEmoteResolver(config)
+	r.fetch(emoteScopeGlobal)
+	r.mutex.Lock()
+	r.sets["123"] = map[string][]thirdPartyEmote{}
+	r.mutex.Unlock()
+	r.fetch("123")
+
+	for _, provider := range config.Providers {
+		if _, err := os.Stat(r.cachePath(provider, emoteScopeGlobal)); err != nil {
+			t.Errorf("%s global set wasn't cached: %v", provider, err)
+		}
+	}
+
+	// "🎉" is one code point but two UTF-16 units. BTTV has a Kappa too, but
+	// Twitch already covers that word
+	message := "🎉 catJAM KEKW Kappa catJAM sevenChan notDefault"
+	twitchEmotes := []TwitchWSMsgEmote{{
+		Name:      "Kappa",
+		Id:        "25",
+		Positions: []TwitchWSMsgEmotePos{{14, 18}},
+	}}
+
+	got := emotePositions(r.annotate("123", message, twitchEmotes))
+	want := []string{
+		// 7TV is listed before BTTV, so its global catJAM wins
+		"7tv/s1@2-7",
+		"7tv/s1@20-25",
+		"7tv/s3@27-35",
+		// the channel's BTTV KEKW wins over 7TV's global one
+		"bttv/b4@9-12",
+		"twitch/25@14-18",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("annotate in channel 123:\n got %v\nwant %v", got, want)
+	}
+
+	// other channels only get the global sets
+	got = emotePositions(r.annotate("", "KEKW sevenChan", nil))
+	want = []string{"7tv/s2@0-3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("annotate without a channel:\n got %v\nwant %v", got, want)
+	}
+
+	// and with emotes turned off, messages pass through untouched
+	var off *emoteResolver
+	if got := off.annotate("123", message, twitchEmotes); !reflect.DeepEqual(got, twitchEmotes) {
+		t.Errorf("nil resolver changed the emotes: %v", got)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// -------------=========== EVENTSUB
+
+const (
+	defaultEventSubWSUrl  = "wss://eventsub.wss.twitch.tv/ws"
+	defaultEventSubApiUrl = "https://api.twitch.tv/helix"
+	defaultRewardHold     = 5
+
+	redemptionSubType    = "channel.channel_points_custom_reward_redemption.add"
+	redemptionQueueSize  = 50
+	eventSubRetryDelay   = 10 * time.Second
+	eventSubSeenMessages = 100
+)
+
+// STEventSubConfig sets up channel-points redemptions. The URLs can be pointed
+// at a local mock EventSub server for testing.
+type STEventSubConfig struct {
+	WebSocketUrl  string `json:"webSocketUrl,omitempty"`
+	ApiUrl        string `json:"apiUrl,omitempty"`
+	ClientId      string `json:"clientId,omitempty"`
+	Token         string `json:"token,omitempty"`
+	BroadcasterId string `json:"broadcasterId,omitempty"`
+	// Rewards maps a reward's ID or title to the list its redemption shuffles.
+	Rewards map[string]int64 `json:"rewards,omitempty"`
+	// HoldSeconds is how long a result stays up after its animation before the
+	// next redemption is shuffled.
+	HoldSeconds int `json:"holdSeconds,omitempty"`
+}
+
+type eventSubMessage struct {
+	Metadata struct {
+		MessageId        string `json:"message_id"`
+		MessageType      string `json:"message_type"`
+		SubscriptionType string `json:"subscription_type"`
+	} `json:"metadata"`
+	Payload struct {
+		Session *struct {
+			Id                      string `json:"id"`
+			KeepaliveTimeoutSeconds int    `json:"keepalive_timeout_seconds"`
+			ReconnectUrl            string `json:"reconnect_url"`
+		} `json:"session"`
+		Subscription *struct {
+			Id     string `json:"id"`
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"subscription"`
+		Event json.RawMessage `json:"event"`
+	} `json:"payload"`
+}
+
+type eventSubRedemption struct {
+	Id        string `json:"id"`
+	UserName  string `json:"user_name"`
+	UserInput string `json:"user_input"`
+	Reward    struct {
+		Id    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"reward"`
+}
+
+type queuedRedemption struct {
+	redemption eventSubRedemption
+	listId     int64
+}
+
+var redemptionQueue = make(chan queuedRedemption, redemptionQueueSize)
+
+// rewardList finds the list a reward shuffles, by the reward's ID first and
+// then its title.
+func (config STEventSubConfig) rewardList(redemption eventSubRedemption) (int64, bool) {
+	if listId, ok := config.Rewards[redemption.Reward.Id]; ok {
+		return listId, true
+	}
+	listId, ok := config.Rewards[redemption.Reward.Title]
+	return listId, ok
+}
+
+// subscribe asks Twitch to send redemptions to the given EventSub session.
+func (config STEventSubConfig) subscribe(sessionId string) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"type":      redemptionSubType,
+		"version":   "1",
+		"condition": map[string]string{"broadcaster_user_id": config.BroadcasterId},
+		"transport": map[string]string{"method": "websocket", "session_id": sessionId},
+	})
+
+	req, err := http.NewRequest("POST", config.ApiUrl+"/eventsub/subscriptions", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Client-Id", config.ClientId)
+	req.Header.Set("Authorization", "Bearer "+config.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("subscription refused (%d): %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// eventSubHandler keeps an EventSub WebSocket session open and queues up
+// redemptions of the configured rewards.
+func eventSubHandler(config STEventSubConfig) {
+	for {
+		err := eventSubSession(config)
+		fmt.Printf("EventSub disconnected: %v\n", err)
+		time.Sleep(eventSubRetryDelay)
+	}
+}
+
+// eventSubConn is one WebSocket connection of an EventSub session.
+type eventSubConn struct {
+	conn *websocket.Conn
+}
+
+// eventSubRead is a message read from one of a session's connections, or the
+// error that ended it.
+type eventSubRead struct {
+	from *eventSubConn
+	msg  eventSubMessage
+	err  error
+}
+
+// dialEventSub connects to EventSub and passes everything read from the
+// connection on to reads, until it drops or done is closed.
+func dialEventSub(url string, reads chan<- eventSubRead, done <-chan struct{}) (*eventSubConn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Connected to EventSub at " + url)
+	ec := &eventSubConn{conn}
+
+	go func() {
+		keepalive := 30 * time.Second
+		for {
+			conn.SetReadDeadline(time.Now().Add(keepalive + 10*time.Second))
+			read := eventSubRead{from: ec}
+			_, p, err := conn.ReadMessage()
+			if err != nil {
+				read.err = err
+			} else if err := json.Unmarshal(p, &read.msg); err != nil {
+				log.Println("Error parsing EventSub message:", err)
+				continue
+			} else if session := read.msg.Payload.Session; read.msg.Metadata.MessageType == "session_welcome" &&
+				session != nil && session.KeepaliveTimeoutSeconds > 0 {
+				keepalive = time.Duration(session.KeepaliveTimeoutSeconds) * time.Second
+			}
+
+			select {
+			case reads <- read:
+			case <-done:
+				return
+			}
+			if read.err != nil {
+				return
+			}
+		}
+	}()
+	return ec, nil
+}
+
+// eventSubSession runs an EventSub session until it drops. When Twitch asks
+// for a reconnect, the old connection is kept open, and its events still
+// handled, until the new one is welcomed. Subscriptions carry over on a
+// reconnect, so they're only made once per session.
+func eventSubSession(config STEventSubConfig) error {
+	reads := make(chan eventSubRead)
+	done := make(chan struct{})
+	defer close(done)
+
+	current, err := dialEventSub(config.WebSocketUrl, reads, done)
+	if err != nil {
+		return err
+	}
+	// previous is the connection being replaced during a reconnect
+	var previous *eventSubConn
+	defer func() {
+		current.conn.Close()
+		if previous != nil {
+			previous.conn.Close()
+		}
+	}()
+
+	seen := map[string]bool{}
+	var seenOrder []string
+	subscribed := false
+
+	for {
+		read := <-reads
+		if read.err != nil {
+			if read.from != current {
+				// the old connection can go once it's been replaced
+				if read.from == previous {
+					previous = nil
+				}
+				continue
+			}
+			return read.err
+		}
+		msg := read.msg
+
+		// Twitch may send a message more than once, even across a reconnect
+		if seen[msg.Metadata.MessageId] {
+			continue
+		}
+		seen[msg.Metadata.MessageId] = true
+		seenOrder = append(seenOrder, msg.Metadata.MessageId)
+		if len(seenOrder) > eventSubSeenMessages {
+			delete(seen, seenOrder[0])
+			seenOrder = seenOrder[1:]
+		}
+
+		switch msg.Metadata.MessageType {
+		case "session_welcome":
+			if msg.Payload.Session == nil || read.from != current {
+				continue
+			}
+			if previous != nil {
+				previous.conn.Close()
+				previous = nil
+				fmt.Println("EventSub reconnected")
+			}
+			if !subscribed {
+				if err := config.subscribe(msg.Payload.Session.Id); err != nil {
+					return err
+				}
+				subscribed = true
+				fmt.Println("Subscribed to channel-points redemptions")
+			}
+		case "session_reconnect":
+			if msg.Payload.Session == nil || msg.Payload.Session.ReconnectUrl == "" {
+				continue
+			}
+			fmt.Println("EventSub asked to reconnect")
+			next, err := dialEventSub(msg.Payload.Session.ReconnectUrl, reads, done)
+			if err != nil {
+				return err
+			}
+			if previous != nil {
+				previous.conn.Close()
+			}
+			previous, current = current, next
+		case "revocation":
+			status := "unknown"
+			if msg.Payload.Subscription != nil {
+				status = msg.Payload.Subscription.Status
+			}
+			return fmt.Errorf("subscription revoked: %s", status)
+		case "notification":
+			if msg.Metadata.SubscriptionType != redemptionSubType {
+				continue
+			}
+			var redemption eventSubRedemption
+			if err := json.Unmarshal(msg.Payload.Event, &redemption); err != nil {
+				log.Println("Error parsing redemption:", err)
+				continue
+			}
+			queueRedemption(config, redemption)
+		}
+	}
+}
+
+func queueRedemption(config STEventSubConfig, redemption eventSubRedemption) {
+	listId, ok := config.rewardList(redemption)
+	if !ok {
+		return
+	}
+
+	select {
+	case redemptionQueue <- queuedRedemption{redemption, listId}:
+		fmt.Printf("%s redeemed %s; queued a shuffle of list %d\n",
+			redemption.UserName, redemption.Reward.Title, listId)
+	default:
+		fmt.Printf("Redemption queue full; dropped %s's redemption\n", redemption.UserName)
+	}
+}
+
+// redemptionWorker shuffles queued redemptions one at a time, waiting for each
+// animation to finish and its result to be shown before starting the next.
+func redemptionWorker(config STEventSubConfig) {
+	for queued := range redemptionQueue {
+		dbAccessMutex.Lock()
+		result, err := shuffleList(int(queued.listId), defaultShuffleOptions())
+		dbAccessMutex.Unlock()
+
+		if err != nil {
+			fmt.Printf("Shuffle for %s's redemption failed: %v\n", queued.redemption.UserName, err)
+			continue
+		}
+
+		broadcastShuffle(result)
+		chatAnnounce(fmt.Sprintf("%s redeemed %s: %s", queued.redemption.UserName,
+			queued.redemption.Reward.Title, gameDisplayName(result.Game)))
+
+		time.Sleep(time.Duration(result.Timeline.Duration)*time.Millisecond +
+			time.Duration(config.HoldSeconds)*time.Second)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const eventSubTestTimeout = 5 * time.Second
+
+func eventSubWelcome(messageId string, sessionId string) string {
+	return fmt.Sprintf(`{"metadata":{"message_id":%q,"message_type":"session_welcome"},`+
+		`"payload":{"session":{"id":%q,"keepalive_timeout_seconds":10}}}`, messageId, sessionId)
+}
+
+func eventSubReconnect(messageId string, url string) string {
+	return fmt.Sprintf(`{"metadata":{"message_id":%q,"message_type":"session_reconnect"},`+
+		`"payload":{"session":{"id":"session","reconnect_url":%q}}}`, messageId, url)
+}
+
+func eventSubNotification(messageId string, redemptionId string) string {
+	return fmt.Sprintf(`{"metadata":{"message_id":%q,"message_type":"notification","subscription_type":%q},`+
+		`"payload":{"event":{"id":%q,"user_name":"viewer","reward":{"id":"reward","title":"Shuffle"}}}}`,
+		messageId, redemptionSubType, redemptionId)
+}
+
+func sendEventSub(t *testing.T, conn *websocket.Conn, msg string) {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("writing to EventSub client: %v", err)
+	}
+}
+
+func acceptEventSub(t *testing.T, conns chan *websocket.Conn) *websocket.Conn {
+	t.Helper()
+	select {
+	case conn := <-conns:
+		return conn
+	case <-time.After(eventSubTestTimeout):
+		t.Fatal("EventSub client never connected")
+		return nil
+	}
+}
+
+func expectRedemption(t *testing.T, id string) {
+	t.Helper()
+	select {
+	case queued := <-redemptionQueue:
+		if queued.redemption.Id != id {
+			t.Fatalf("queued redemption %q, want %q", queued.redemption.Id, id)
+		}
+		if queued.listId != 7 {
+			t.Fatalf("redemption queued for list %d, want 7", queued.listId)
+		}
+	case <-time.After(eventSubTestTimeout):
+		t.Fatalf("redemption %q was never queued", id)
+	}
+}
+
+// TestEventSubSession runs a session against a mock EventSub server through a
+// duplicate notification and a reconnect.
+func TestEventSubSession(t *testing.T) {
+	for len(redemptionQueue) > 0 {
+		<-redemptionQueue
+	}
+
+	var subscriptions int32
+	firstConns := make(chan *websocket.Conn, 1)
+	reconnectConns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	accept := func(conns chan *websocket.Conn) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", accept(firstConns))
+	mux.HandleFunc("/reconnect", accept(reconnectConns))
+	mux.HandleFunc("/helix/eventsub/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&subscriptions, 1)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	wsUrl := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	config := STEventSubConfig{
+		WebSocketUrl: wsUrl + "/ws",
+		ApiUrl:       server.URL + "/helix",
+		Rewards:      map[string]int64{"Shuffle": 7},
+	}
+	sessionErr := make(chan error, 1)
+	go func() { sessionErr <- eventSubSession(config) }()
+
+	first := acceptEventSub(t, firstConns)
+	defer first.Close()
+	sendEventSub(t, first, eventSubWelcome("welcome-1", "session"))
+	sendEventSub(t, first, eventSubNotification("note-1", "redemption-1"))
+	sendEventSub(t, first, eventSubNotification("note-1", "redemption-1"))
+	expectRedemption(t, "redemption-1")
+
+	sendEventSub(t, first, eventSubReconnect("reconnect-1", wsUrl+"/reconnect"))
+	second := acceptEventSub(t, reconnectConns)
+	defer second.Close()
+
+	// until the new connection is welcomed, the old one is still read
+	sendEventSub(t, first, eventSubNotification("note-2", "redemption-2"))
+	expectRedemption(t, "redemption-2")
+
+	// and once it is, the old one's closed
+	sendEventSub(t, second, eventSubWelcome("welcome-2", "session"))
+	first.SetReadDeadline(time.Now().Add(eventSubTestTimeout))
+	if _, _, err := first.ReadMessage(); err == nil {
+		t.Fatal("old connection sent a message after the reconnect")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("old connection was left open after the reconnect")
+	}
+
+	// duplicates are dropped across the reconnect too
+	sendEventSub(t, second, eventSubNotification("note-1", "redemption-1"))
+	sendEventSub(t, second, eventSubNotification("note-3", "redemption-3"))
+	expectRedemption(t, "redemption-3")
+
+	if n := atomic.LoadInt32(&subscriptions); n != 1 {
+		t.Fatalf("subscribed %d times, want once", n)
+	}
+
+	second.Close()
+	select {
+	case err := <-sessionErr:
+		if err == nil {
+			t.Fatal("session ended without an error")
+		}
+	case <-time.After(eventSubTestTimeout):
+		t.Fatal("session didn't end when its connection dropped")
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// -------------=========== EXPORT
+
+// listGames returns every game in a list, with its tags. The caller must hold
+// dbAccessMutex.
+func listGames(listId int64) ([]STGame, error) {
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM lists WHERE listId = ?)`, listId).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &apiError{fmt.Sprintf("List ID not found: %d", listId), http.StatusNotFound}
+	}
+
+	stmt := `SELECT * FROM games WHERE listId = ? ORDER BY gameId`
+	rows, err := db.Query(stmt, listId)
+	if err != nil {
+		fmt.Printf("%q: during query %s\n", err, stmt)
+		return nil, err
+	}
+	defer rows.Close()
+
+	games := []STGame{}
+	var activeDisplayName string
+	for rows.Next() {
+		var game STGame
+		if err := rows.Scan(&game.Id, &game.ListId, &game.Name, &game.DisplayName, &game.Description,
+			&game.Weight, &game.Status, &activeDisplayName); err != nil {
+			fmt.Printf("%q: during exec %s\n", err, stmt)
+			return nil, err
+		}
+		games = append(games, game)
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Printf("%q: after exec %s\n", err, stmt)
+		return nil, err
+	}
+
+	if err := attachTags(games); err != nil {
+		return nil, err
+	}
+	return games, nil
+}
+
+// writeGamesCsv writes games with the same columns the importer reads, so an
+// export can be imported again.
+func writeGamesCsv(w io.Writer, games []STGame) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(importColumns); err != nil {
+		return err
+	}
+
+	for _, game := range games {
+		weight, status := 0, 0
+		if value := game.Weight.Get(); value != nil {
+			weight = *value
+		}
+		if value := game.Status.Get(); value != nil {
+			status = *value
+		}
+		displayName, description := "", ""
+		if value := game.DisplayName.Get(); value != nil {
+			displayName = *value
+		}
+		if value := game.Description.Get(); value != nil {
+			description = *value
+		}
+
+		record := []string{
+			game.Name,
+			displayName,
+			description,
+			strconv.Itoa(weight),
+			strconv.Itoa(status),
+			strings.Join(flagNames(status), ","),
+			strings.Join(game.Tags, ","),
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// exportList sends every game in a list as JSON, or as CSV with format=csv.
+// Both can be read back in by importList.
+func exportList(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: exportList\n")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Invalid ID: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = importFormatJson
+	}
+	if format != importFormatJson && format != importFormatCsv {
+		outputApiError(w, fmt.Sprintf("Unknown export format: %q", format), http.StatusBadRequest)
+		return
+	}
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	games, err := listGames(id)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputErr(w, err)
+		return
+	}
+
+	filename := fmt.Sprintf("list-%d.%s", id, format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == importFormatCsv {
+		w.Header().Set("Content-Type", "text/csv")
+		if err := writeGamesCsv(w, games); err != nil {
+			fmt.Printf("err: %v\n", err)
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(games)
+	}
+}
+
+// -------------=========== BACKUP
+
+const backupContentType = "application/vnd.sqlite3"
+
+type STRestoreResult struct {
+	// BackupVersion is the schema version the backup was taken at, and
+	// SchemaVersion the one the database was migrated to after restoring it.
+	BackupVersion int `json:"backupVersion"`
+	SchemaVersion int `json:"schemaVersion"`
+}
+
+// copyDb copies one database over another with SQLite's online backup, which
+// is safe while the source is in use.
+func copyDb(dest *sql.DB, src *sql.DB) error {
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriver interface{}) error {
+		return srcConn.Raw(func(srcDriver interface{}) error {
+			destSqlite, ok := destDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("backup needs a SQLite connection")
+			}
+			srcSqlite, ok := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("backup needs a SQLite connection")
+			}
+
+			backup, err := destSqlite.Backup("main", srcSqlite, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// backupDb snapshots the database into the file at path. The caller must hold
+// dbAccessMutex.
+func backupDb(path string) error {
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return copyDb(dest, db)
+}
+
+// openBackup opens a backup read-only.
+func openBackup(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", "file:"+(&url.URL{Path: path}).String()+"?mode=ro")
+}
+
+// backupVersion checks that a backup is an intact shuffletron database this
+// build can restore, and returns its schema version.
+func backupVersion(backup *sql.DB) (int, error) {
+	var check string
+	if err := backup.QueryRow(`PRAGMA quick_check`).Scan(&check); err != nil {
+		return 0, &apiError{fmt.Sprintf("Backup is not a SQLite database: %v", err), http.StatusBadRequest}
+	}
+	if check != "ok" {
+		return 0, &apiError{fmt.Sprintf("Backup is damaged: %s", check), http.StatusBadRequest}
+	}
+
+	var version int
+	if err := backup.QueryRow(`SELECT IFNULL(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, &apiError{fmt.Sprintf("Backup has no schema version: %v", err), http.StatusBadRequest}
+	}
+	if version < 1 {
+		return 0, &apiError{"Backup has no schema version", http.StatusBadRequest}
+	}
+	if version > len(migrations) {
+		return 0, &apiError{fmt.Sprintf("Backup is at schema version %d, but this build only knows up to %d",
+			version, len(migrations)), http.StatusBadRequest}
+	}
+	return version, nil
+}
+
+// restoreDb replaces the database with the backup at path, once its schema
+// version has been checked, and then migrates it up to date. It takes
+// dbAccessMutex itself, and holds it until the migration's done so nothing
+// runs against an older backup's schema.
+func restoreDb(path string) (STRestoreResult, error) {
+	var result STRestoreResult
+
+	backup, err := openBackup(path)
+	if err != nil {
+		return result, err
+	}
+	defer backup.Close()
+
+	if result.BackupVersion, err = backupVersion(backup); err != nil {
+		return result, err
+	}
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	if err := copyDb(db, backup); err != nil {
+		return result, err
+	}
+	if err := migrateDbLocked(false); err != nil {
+		return result, err
+	}
+	result.SchemaVersion = len(migrations)
+	return result, nil
+}
+
+// serverLockFile is kept locked by a running server, so the restore command
+// can tell not to replace the database underneath it. SQLite does the
+// locking, so the lock goes when the process does, however it ends.
+const serverLockFile = "./shuffletron.lock"
+
+// lockServer takes the server lock, which is held until release is called or
+// the process exits. It fails straight away if something else has it.
+func lockServer() (release func(), err error) {
+	lock, err := sql.Open("sqlite3", "file:"+serverLockFile+"?_txlock=exclusive&_busy_timeout=0")
+	if err != nil {
+		return nil, err
+	}
+	lock.SetMaxOpenConns(1)
+
+	tx, err := lock.Begin()
+	if err != nil {
+		lock.Close()
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrBusy {
+			return nil, fmt.Errorf("shuffletron is already running against this database")
+		}
+		return nil, err
+	}
+	return func() {
+		tx.Rollback()
+		lock.Close()
+	}, nil
+}
+
+// backupFilename names a backup after the time it was taken.
+func backupFilename() string {
+	return fmt.Sprintf("shuffletron-%s.sqlite3", time.Now().Format("20060102-150405"))
+}
+
+// downloadBackup sends a snapshot of the whole database.
+func downloadBackup(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: downloadBackup\n")
+
+	file, err := ioutil.TempFile("", "shuffletron-backup-*.sqlite3")
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Error making backup: %q", err), http.StatusInternalServerError)
+		return
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	dbAccessMutex.Lock()
+	err = backupDb(file.Name())
+	dbAccessMutex.Unlock()
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Error making backup: %q", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", backupContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", backupFilename()))
+	http.ServeFile(w, r, file.Name())
+}
+
+// uploadRestore replaces the database with the backup in the request body.
+func uploadRestore(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: uploadRestore\n")
+
+	file, err := ioutil.TempFile("", "shuffletron-restore-*.sqlite3")
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Error reading backup: %q", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, r.Body)
+	file.Close()
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Invalid data: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	result, err := restoreDb(file.Name())
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputErr(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// backupCommand is the backup subcommand:
+//
+//	shuffletron backup [file]
+//
+// It's safe to run while the server is up, and takes the database as it is
+// without migrating it. The file defaults to one named after the current time,
+// and is never overwritten.
+func backupCommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		return fmt.Errorf("usage: shuffletron backup [file]")
+	}
+
+	path := backupFilename()
+	if flags.NArg() == 1 {
+		path = flags.Arg(0)
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+	if err := backupDb(path); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up to %s\n", path)
+	return nil
+}
+
+// restoreCommand is the restore subcommand:
+//
+//	shuffletron restore <file>
+//
+// It's only for when the server is stopped, and refuses to run otherwise; a
+// running server would carry on with a database that had changed underneath
+// it. To restore while the server is up, POST the backup to /restore instead.
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: shuffletron restore <file>")
+	}
+	if _, err := os.Stat(flags.Arg(0)); err != nil {
+		return err
+	}
+
+	release, err := lockServer()
+	if err != nil {
+		return fmt.Errorf("%v; stop the server first, or POST the backup to /restore", err)
+	}
+	defer release()
+
+	result, err := restoreDb(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s from schema version %d\n", flags.Arg(0), result.BackupVersion)
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// seedExportList fills list 1 with games that cover every column, including
+// a weight of 0 and a status bit no flag uses.
+func seedExportList(t *testing.T) {
+	t.Helper()
+	testExec(t, `INSERT INTO lists (listId, listName) VALUES (1, 'from'), (2, 'to')`)
+	testExec(t, `INSERT INTO games (gameId, listId, gameName, displayName, description, weight, status)
+		VALUES (1, 1, 'plain', NULL, NULL, 1, 0),
+			(2, 1, 'never', 'Never Picked', 'weight 0, "quoted", comma', 0, 0),
+			(3, 1, 'played', NULL, 'two
+lines', 5, 9)`)
+	if err := tagGame(3, []string{"co-op", "short"}, false); err != nil {
+		t.Fatalf("tagging: %v", err)
+	}
+}
+
+// exportedGames strips what an import doesn't carry over, so lists can be
+// compared.
+func exportedGames(t *testing.T, listId int64) string {
+	t.Helper()
+	games, err := listGames(listId)
+	if err != nil {
+		t.Fatalf("listing games: %v", err)
+	}
+	for x := range games {
+		games[x].Id = 0
+		games[x].ListId = 0
+	}
+	out, _ := json.Marshal(games)
+	return string(out)
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []string{importFormatJson, importFormatCsv} {
+		t.Run(format, func(t *testing.T) {
+			useTestDb(t)
+			seedExportList(t)
+
+			games, err := listGames(1)
+			if err != nil {
+				t.Fatalf("listing games: %v", err)
+			}
+			var exported bytes.Buffer
+			if format == importFormatCsv {
+				err = writeGamesCsv(&exported, games)
+			} else {
+				err = json.NewEncoder(&exported).Encode(games)
+			}
+			if err != nil {
+				t.Fatalf("exporting: %v", err)
+			}
+
+			entries, err := parseImport(format, exported.Bytes(), nil)
+			if err != nil {
+				t.Fatalf("parsing export: %v", err)
+			}
+			result, err := importGames(2, entries)
+			if err != nil {
+				t.Fatalf("importing: %v", err)
+			}
+			if result.Created != len(games) || result.Errored != 0 || result.Skipped != 0 {
+				t.Fatalf("import created %d, skipped %d, errored %d: %+v",
+					result.Created, result.Skipped, result.Errored, result.Rows)
+			}
+
+			if from, to := exportedGames(t, 1), exportedGames(t, 2); from != to {
+				t.Errorf("imported list differs:\n from %s\n   to %s", from, to)
+			}
+		})
+	}
+}
+
+func TestImportChecksLikeTheApi(t *testing.T) {
+	useTestDb(t)
+	testExec(t, `INSERT INTO lists (listId, listName) VALUES (1, 'list')`)
+
+	entries, err := parseImport(importFormatCsv, []byte("name,weight,status\nzero,0,0\nnegative,-1,0\nbad status,1,-2\n"), nil)
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	result, err := importGames(1, entries)
+	if err != nil {
+		t.Fatalf("importing: %v", err)
+	}
+
+	var outcomes []string
+	for _, row := range result.Rows {
+		outcomes = append(outcomes, row.Outcome)
+	}
+	want := []string{importCreated, importErrored, importErrored}
+	if !reflect.DeepEqual(outcomes, want) {
+		t.Errorf("outcomes %v, want %v: %+v", outcomes, want, result.Rows)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	useTestDb(t)
+	seedExportList(t)
+	before := exportedGames(t, 1)
+
+	path := filepath.Join(t.TempDir(), "backup.sqlite3")
+	if err := backupDb(path); err != nil {
+		t.Fatalf("backing up: %v", err)
+	}
+	testExec(t, `DELETE FROM games`)
+	testExec(t, `DELETE FROM game_tags`)
+
+	result, err := restoreDb(path)
+	if err != nil {
+		t.Fatalf("restoring: %v", err)
+	}
+	if result.BackupVersion != len(migrations) || result.SchemaVersion != len(migrations) {
+		t.Errorf("restore result %+v, want both versions %d", result, len(migrations))
+	}
+	if after := exportedGames(t, 1); after != before {
+		t.Errorf("restored list differs:\n before %s\n  after %s", before, after)
+	}
+}
+
+func TestRestoreMigratesOldBackups(t *testing.T) {
+	useTestDb(t)
+	seedExportList(t)
+
+	// take the backup back to before tags
+	path := filepath.Join(t.TempDir(), "backup.sqlite3")
+	if err := backupDb(path); err != nil {
+		t.Fatalf("backing up: %v", err)
+	}
+	useTestDb(t)
+	backupFile, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{`DROP TABLE game_tags`, `DROP TABLE tags`,
+		`DELETE FROM schema_migrations WHERE version = 5`} {
+		if _, err := backupFile.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	backupFile.Close()
+
+	result, err := restoreDb(path)
+	if err != nil {
+		t.Fatalf("restoring: %v", err)
+	}
+	if result.BackupVersion != 4 || result.SchemaVersion != len(migrations) {
+		t.Errorf("restore result %+v, want 4 migrated to %d", result, len(migrations))
+	}
+	if err := tagGame(3, []string{"again"}, true); err != nil {
+		t.Errorf("tagging after restoring an old backup: %v", err)
+	}
+}
+
+func TestRestoreRejectsBadBackups(t *testing.T) {
+	useTestDb(t)
+	dir := t.TempDir()
+
+	notDb := filepath.Join(dir, "not.sqlite3")
+	if err := ioutil.WriteFile(notDb, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restoreDb(notDb); err == nil {
+		t.Error("restored a file that isn't a database")
+	} else if aerr, ok := err.(*apiError); !ok || aerr.status != http.StatusBadRequest {
+		t.Errorf("bad backup gave %v, want a 400", err)
+	}
+
+	// a backup from a newer build
+	newer := filepath.Join(dir, "newer.sqlite3")
+	if err := backupDb(newer); err != nil {
+		t.Fatal(err)
+	}
+	backupFile, err := sql.Open("sqlite3", newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backupFile.Exec(`INSERT INTO schema_migrations (version, name, appliedAt) VALUES (?, 'future', 0)`,
+		len(migrations)+1); err != nil {
+		t.Fatal(err)
+	}
+	backupFile.Close()
+	if _, err := restoreDb(newer); err == nil {
+		t.Error("restored a backup from a newer schema")
+	}
+}
+
+// TestServerLock checks the restore command can't take the lock while a
+// server has it, and can once it's gone.
+func TestServerLock(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	release, err := lockServer()
+	if err != nil {
+		t.Fatalf("taking the lock: %v", err)
+	}
+	if err := restoreCommand([]string{serverLockFile}); err == nil || !strings.Contains(err.Error(), "stop the server") {
+		t.Errorf("restore with the server running gave %v, want it refused", err)
+	}
+	if again, err := lockServer(); err == nil {
+		again()
+		t.Error("lock was taken twice")
+	}
+
+	release()
+	again, err := lockServer()
+	if err != nil {
+		t.Fatalf("taking the lock once it was released: %v", err)
+	}
+	again()
+}
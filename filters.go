@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// -------------=========== CHAT FILTERS
+
+// filterAllChannels is the filter for channels that don't have their own.
+const filterAllChannels = "*"
+
+// defaultLinkBadges are the badges allowed to post links when a filter blocks
+// them and doesn't say who can.
+var defaultLinkBadges = []string{"broadcaster", "moderator"}
+
+// linkPattern is a rough match for anything that looks like a link.
+var linkPattern = regexp.MustCompile(`(?i)\b(https?://\S+|www\.\S+|[a-z0-9-]+(\.[a-z0-9-]+)*\.(com|net|org|tv|gg|io|ly|me|co|xyz|be)\b\S*)`)
+
+// STChatFilter says what chat to keep off the overlay. Chat commands still
+// work in messages that get filtered.
+type STChatFilter struct {
+	// Bots are users whose messages are dropped, matched by display name
+	Bots         []string `json:"bots,omitempty"`
+	DropCommands bool     `json:"dropCommands"`
+	// BlockedWords are matched as whole words, ignoring case; BlockedPatterns
+	// are regular expressions.
+	BlockedWords    []string `json:"blockedWords,omitempty"`
+	BlockedPatterns []string `json:"blockedPatterns,omitempty"`
+	// BlockLinks drops links from anyone without one of LinkBadges.
+	BlockLinks bool     `json:"blockLinks"`
+	LinkBadges []string `json:"linkBadges,omitempty"`
+}
+
+// chatFilter is an STChatFilter ready to be run.
+type chatFilter struct {
+	bots         map[string]bool
+	dropCommands bool
+	blocked      []*regexp.Regexp
+	blockLinks   bool
+	linkBadges   []string
+}
+
+// chatFilters holds the filter for each channel, keyed by normalised channel
+// name or filterAllChannels.
+type chatFilters struct {
+	mutex    sync.RWMutex
+	config   map[string]STChatFilter
+	channels map[string]*chatFilter
+}
+
+var filters = &chatFilters{channels: map[string]*chatFilter{}}
+
+func compileChatFilter(config STChatFilter) (*chatFilter, error) {
+	filter := &chatFilter{
+		bots:         map[string]bool{},
+		dropCommands: config.DropCommands,
+		blockLinks:   config.BlockLinks,
+		linkBadges:   config.LinkBadges,
+	}
+	if filter.linkBadges == nil {
+		filter.linkBadges = defaultLinkBadges
+	}
+
+	for _, bot := range config.Bots {
+		filter.bots[strings.ToLower(bot)] = true
+	}
+	for _, word := range config.BlockedWords {
+		filter.blocked = append(filter.blocked, regexp.MustCompile(`(?i)\b`+regexp.QuoteMeta(word)+`\b`))
+	}
+	for _, pattern := range config.BlockedPatterns {
+		blocked, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+		}
+		filter.blocked = append(filter.blocked, blocked)
+	}
+
+	return filter, nil
+}
+
+// set swaps in new filters. If any of them doesn't compile, the old ones are
+// kept.
+func (f *chatFilters) set(config map[string]STChatFilter) error {
+	if config == nil {
+		config = map[string]STChatFilter{}
+	}
+
+	channels := map[string]*chatFilter{}
+	for channel, filterConfig := range config {
+		filter, err := compileChatFilter(filterConfig)
+		if err != nil {
+			return fmt.Errorf("filter for %s: %v", channel, err)
+		}
+		if channel != filterAllChannels {
+			channel = normalizeChannel(channel)
+		}
+		channels[channel] = filter
+	}
+
+	f.mutex.Lock()
+	f.config = config
+	f.channels = channels
+	f.mutex.Unlock()
+	return nil
+}
+
+// check runs a message through its channel's filter. Returns why the message
+// was dropped, or "" if it can be sent on. Only chat messages are filtered.
+func (f *chatFilters) check(msg TwitchWSMsg) string {
+	if msg.MsgType != msgTypeMessage && msg.MsgType != msgTypeAction {
+		return ""
+	}
+
+	f.mutex.RLock()
+	filter, ok := f.channels[normalizeChannel(msg.Channel)]
+	if !ok {
+		filter = f.channels[filterAllChannels]
+	}
+	f.mutex.RUnlock()
+	if filter == nil {
+		return ""
+	}
+
+	if filter.bots[strings.ToLower(msg.DisplayName)] {
+		return "bot"
+	}
+	if filter.dropCommands && strings.HasPrefix(msg.Message, "!") {
+		return "command"
+	}
+	for _, blocked := range filter.blocked {
+		if blocked.MatchString(msg.Message) {
+			return "blocked"
+		}
+	}
+	if filter.blockLinks && linkPattern.MatchString(msg.Message) {
+		for _, badge := range filter.linkBadges {
+			if _, ok := msg.Badges[badge]; ok {
+				return ""
+			}
+		}
+		return "link"
+	}
+	return ""
+}
+
+func returnChatFilters(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: returnChatFilters\n")
+
+	filters.mutex.RLock()
+	defer filters.mutex.RUnlock()
+
+	json.NewEncoder(w).Encode(filters.config)
+}
+
+// reloadChatFilters reads the filters from stconfig.json again, so they can be
+// changed without a restart.
+func reloadChatFilters(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: reloadChatFilters\n")
+
+	file, err := os.ReadFile(configFile)
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Could not read %s: %q", configFile, err), http.StatusInternalServerError)
+		return
+	}
+
+	var config STConfig
+	if err := json.Unmarshal(file, &config); err != nil {
+		outputApiError(w, fmt.Sprintf("Could not parse %s: %q", configFile, err), http.StatusBadRequest)
+		return
+	}
+
+	if err := filters.set(config.Filters); err != nil {
+		outputApiError(w, fmt.Sprintf("Invalid filters: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("Reloaded chat filters for %d channel(s)\n", len(config.Filters))
+	json.NewEncoder(w).Encode(config.Filters)
+}
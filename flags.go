@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// -------------=========== STATUS FLAGS
+
+const (
+	flagPlayed      = 1
+	flagMultiplayer = 2
+)
+
+// STFlag gives a bit of STGame.Status its meaning.
+type STFlag struct {
+	Name        string `json:"name"`
+	Bit         int    `json:"bit"`
+	Description string `json:"description"`
+	// ExcludeByDefault leaves games with the flag out of shuffles unless a
+	// shuffle asks otherwise.
+	ExcludeByDefault bool `json:"excludeByDefault"`
+}
+
+// statusFlags is the registry of status flags. Bits are stored in the
+// database, so once a flag is added its bit must never change.
+var statusFlags = []STFlag{
+	{"played", flagPlayed, "Already played", true},
+	{"multiplayer", flagMultiplayer, "Played with others", false},
+}
+
+// flagNames lists the names of the flags set in a status.
+func flagNames(status int) []string {
+	names := []string{}
+	for _, flag := range statusFlags {
+		if status&flag.Bit != 0 {
+			names = append(names, flag.Name)
+		}
+	}
+	return names
+}
+
+// flagBits turns flag names into status bits.
+func flagBits(names []string) (int, error) {
+	bits := 0
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		known := false
+		for _, flag := range statusFlags {
+			if strings.EqualFold(flag.Name, name) {
+				bits |= flag.Bit
+				known = true
+				break
+			}
+		}
+		if !known {
+			return 0, fmt.Errorf("Unknown status flag: %q", name)
+		}
+	}
+	return bits, nil
+}
+
+// parseFlags reads status bits given either as an integer or as
+// comma-separated flag names, e.g. "3" or "played,multiplayer".
+func parseFlags(param string) (int, error) {
+	if bits, err := strconv.Atoi(param); err == nil {
+		if bits < 0 {
+			return 0, fmt.Errorf("Invalid status flags: %q", param)
+		}
+		return bits, nil
+	}
+	return flagBits(strings.Split(param, ","))
+}
+
+// knownFlags are the bits of every flag in the registry.
+func knownFlags() int {
+	bits := 0
+	for _, flag := range statusFlags {
+		bits |= flag.Bit
+	}
+	return bits
+}
+
+// defaultExcludeFlags are the bits of every flag shuffles leave out by default.
+func defaultExcludeFlags() int {
+	bits := 0
+	for _, flag := range statusFlags {
+		if flag.ExcludeByDefault {
+			bits |= flag.Bit
+		}
+	}
+	return bits
+}
+
+// MarshalJSON adds the names of the game's status flags.
+func (game STGame) MarshalJSON() ([]byte, error) {
+	type stGameJSON STGame
+	out := stGameJSON(game)
+	out.Flags = []string{}
+	if status := game.Status.Get(); status != nil {
+		out.Flags = flagNames(*status)
+	}
+	return json.Marshal(out)
+}
+
+// applyFlags sets the game's status from the flag names it was sent with, if
+// there were any. Bits no flag in the registry uses are kept from base, the
+// status the game had before. A game sent both has to have them agree, so a
+// stale list of flags can't quietly undo a change to the status.
+func (game *STGame) applyFlags(base int) error {
+	if game.Flags == nil {
+		return nil
+	}
+	bits, err := flagBits(game.Flags)
+	if err != nil {
+		return err
+	}
+
+	if status := game.Status.Get(); status != nil {
+		if *status&knownFlags() != bits {
+			return fmt.Errorf("Status %d doesn't match the flags %q", *status, strings.Join(game.Flags, ","))
+		}
+		return nil
+	}
+	status := base&^knownFlags() | bits
+	game.Status.Set(&status)
+	return nil
+}
+
+func returnAllFlags(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: returnAllFlags\n")
+	json.NewEncoder(w).Encode(statusFlags)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// -------------============== WEBSOCKET HUB
+
+const (
+	defaultWSQueueSize = 64
+
+	// wsOverflowDrop skips messages for a client whose queue is full;
+	// wsOverflowDisconnect closes the client instead.
+	wsOverflowDrop       = "drop"
+	wsOverflowDisconnect = "disconnect"
+
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+
+	// wsMaxRequestSize caps what a client can send; requests are small JSON
+	// subscriptions, so anything bigger gets the client closed.
+	wsMaxRequestSize = 4096
+)
+
+// We'll need to define an Upgrader
+// this will require a Read and Write buffer size
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// TODO: look more into CORS
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+var hub = newTwitchWSHub(defaultWSQueueSize, wsOverflowDrop, defaultBacklogSize)
+
+// TwitchWSHub keeps track of every open WS and fans messages out to them. It
+// also keeps the chat backlog, under the same lock, so a new client gets each
+// message exactly once: either in its replay or live.
+type TwitchWSHub struct {
+	mutex     sync.Mutex
+	clients   map[int]*TwitchWS
+	nextId    int
+	queueSize int
+	overflow  string
+	backlog   *chatBacklog
+}
+
+type TwitchWS struct {
+	hub  *TwitchWSHub
+	conn *websocket.Conn
+	id   int
+	subs *TwitchWSSubscription
+	// send queues messages for wsWriter; once it's full, the hub's overflow
+	// policy kicks in
+	send       chan TwitchWSMsg
+	done       chan struct{}
+	closeOnce  sync.Once
+	writeMutex sync.Mutex
+}
+
+// TwitchWSSubscription holds the channels and events a WS wants to be sent.
+// A nil set means everything.
+type TwitchWSSubscription struct {
+	mutex    sync.Mutex
+	channels map[string]bool
+	events   map[string]bool
+}
+
+// TwitchWSRequest is what a client sends over the WS to change what it's
+// subscribed to.
+type TwitchWSRequest struct {
+	Type     string   `json:"type"`
+	Channels []string `json:"channels"`
+	Events   []string `json:"events"`
+}
+
+func newTwitchWSHub(queueSize int, overflow string, backlogSize int) *TwitchWSHub {
+	return &TwitchWSHub{
+		clients:   map[int]*TwitchWS{},
+		queueSize: queueSize,
+		overflow:  overflow,
+		backlog:   newChatBacklog(backlogSize),
+	}
+}
+
+// add registers a new connection with the hub, queues up the chat backlog it
+// asked for and the chat status, and starts its reader and writer.
+func (h *TwitchWSHub) add(conn *websocket.Conn, subs *TwitchWSSubscription, replay backlogReplay) *TwitchWS {
+	h.mutex.Lock()
+	backlog := h.backlog.replay(subs, replay)
+	if status := chatStatusMsg(currentChatStatus()); subs.wants(status) {
+		backlog = append(backlog, status)
+	}
+	ws := &TwitchWS{
+		hub:  h,
+		conn: conn,
+		id:   h.nextId,
+		subs: subs,
+		send: make(chan TwitchWSMsg, h.queueSize+len(backlog)),
+		done: make(chan struct{}),
+	}
+	for _, msg := range backlog {
+		ws.send <- msg
+	}
+	h.nextId++
+	h.clients[ws.id] = ws
+	h.mutex.Unlock()
+
+	go ws.wsWriter()
+	go ws.wsReader()
+	return ws
+}
+
+func (h *TwitchWSHub) remove(ws *TwitchWS) {
+	h.mutex.Lock()
+	delete(h.clients, ws.id)
+	h.mutex.Unlock()
+}
+
+// broadcast queues a message for every client subscribed to it without
+// waiting on any of them. Returns how many clients it was queued for, out of
+// how many are connected.
+func (h *TwitchWSHub) broadcast(msg TwitchWSMsg) (int, int) {
+	var overflowed []*TwitchWS
+	sentTo := 0
+
+	h.mutex.Lock()
+	h.backlog.record(msg)
+	total := len(h.clients)
+	for _, ws := range h.clients {
+		if !ws.subs.wants(msg) {
+			continue
+		}
+		select {
+		case ws.send <- msg:
+			sentTo++
+		default:
+			overflowed = append(overflowed, ws)
+		}
+	}
+	h.mutex.Unlock()
+
+	for _, ws := range overflowed {
+		if h.overflow == wsOverflowDisconnect {
+			log.Printf("WS %d can't keep up; disconnecting\n", ws.id)
+			ws.close()
+		} else {
+			log.Printf("WS %d can't keep up; dropped a message\n", ws.id)
+		}
+	}
+
+	return sentTo, total
+}
+
+// close shuts the connection down and takes it off the hub. It's safe to call
+// more than once.
+func (ws *TwitchWS) close() {
+	ws.closeOnce.Do(func() {
+		fmt.Printf("Closing WS %d\n", ws.id)
+		close(ws.done)
+		ws.conn.Close()
+		ws.hub.remove(ws)
+	})
+}
+
+// write sends a single frame. Each connection has its own write lock, so a
+// slow client only holds up itself.
+func (ws *TwitchWS) write(messageType int, data []byte) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return ws.conn.WriteMessage(messageType, data)
+}
+
+func normalizeChannel(channel string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(channel), "#"))
+}
+
+// set replaces the subscription. Leaving out channels or events subscribes to
+// all of them.
+func (sub *TwitchWSSubscription) set(channels []string, events []string) error {
+	var channelSet, eventSet map[string]bool
+	if len(channels) > 0 {
+		channelSet = map[string]bool{}
+		for _, channel := range channels {
+			channelSet[normalizeChannel(channel)] = true
+		}
+	}
+	if len(events) > 0 {
+		eventSet = map[string]bool{}
+		for _, event := range events {
+			known := false
+			for _, name := range msgTypeNames {
+				if name == event {
+					known = true
+					break
+				}
+			}
+			if !known {
+				return fmt.Errorf("unknown event type %q", event)
+			}
+			eventSet[event] = true
+		}
+	}
+
+	sub.mutex.Lock()
+	sub.channels = channelSet
+	sub.events = eventSet
+	sub.mutex.Unlock()
+	return nil
+}
+
+// wants checks whether a message matches the subscription. Messages that
+// don't belong to a channel, like shuffles, only go by event type.
+func (sub *TwitchWSSubscription) wants(msg TwitchWSMsg) bool {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+
+	if sub.events != nil && !sub.events[msgTypeNames[msg.MsgType]] {
+		return false
+	}
+	if sub.channels != nil && msg.Channel != "" && !sub.channels[normalizeChannel(msg.Channel)] {
+		return false
+	}
+	return true
+}
+
+// wsWriter sends queued messages to the client, and pings it to make sure
+// it's still there.
+func (ws *TwitchWS) wsWriter() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		ws.close()
+	}()
+
+	for {
+		select {
+		case <-ws.done:
+			return
+		case msg := <-ws.send:
+			outMsg, err := json.Marshal(msg)
+			if err != nil {
+				log.Println("Error in marshall op:", err)
+				continue
+			}
+			if err := ws.write(websocket.TextMessage, outMsg); err != nil {
+				log.Println("Error in WS write op:", err)
+				return
+			}
+		case <-ticker.C:
+			if err := ws.write(websocket.PingMessage, nil); err != nil {
+				log.Println("Error in WS ping:", err)
+				return
+			}
+		}
+	}
+}
+
+// define a wsReader which will listen for
+// new messages being sent to our WebSocket
+// endpoint
+func (ws *TwitchWS) wsReader() {
+	defer ws.close()
+
+	ws.conn.SetReadLimit(wsMaxRequestSize)
+	ws.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	ws.conn.SetPongHandler(func(string) error {
+		ws.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
+	for {
+		// read in a message
+		_, p, err := ws.conn.ReadMessage()
+		if err != nil {
+			log.Println(err)
+			break
+		}
+		// print out that message for clarity
+		fmt.Println(string(p))
+
+		var req TwitchWSRequest
+		if err := json.Unmarshal(p, &req); err != nil {
+			log.Println("Error parsing WS request:", err)
+			continue
+		}
+
+		switch req.Type {
+		case "subscribe":
+			if err := ws.subs.set(req.Channels, req.Events); err != nil {
+				log.Println("Error in WS subscribe:", err)
+			} else {
+				fmt.Printf("WS %d subscribed to channels %v, events %v\n", ws.id, req.Channels, req.Events)
+			}
+		default:
+			log.Printf("Unknown WS request type %q\n", req.Type)
+		}
+	}
+}
+
+func wsEndpoint(w http.ResponseWriter, r *http.Request) {
+	log.Println("WS connection request")
+
+	// the initial subscription can also be given in the query string, e.g.
+	// /ws?channels=a,b&events=message,delete
+	subs := &TwitchWSSubscription{}
+	var channels, events []string
+	if param := r.URL.Query().Get("channels"); param != "" {
+		channels = strings.Split(param, ",")
+	}
+	if param := r.URL.Query().Get("events"); param != "" {
+		events = strings.Split(param, ",")
+	}
+	if err := subs.set(channels, events); err != nil {
+		log.Println("Error in WS subscribe:", err)
+	}
+
+	// as can how much chat to catch up on, e.g. /ws?backlog=20&backlogSeconds=300
+	replay := backlogReplay{seconds: defaultBacklogSeconds}
+	if param := r.URL.Query().Get("backlog"); param != "" {
+		if limit, err := strconv.Atoi(param); err == nil {
+			replay.limit = limit
+		}
+	}
+	if param := r.URL.Query().Get("backlogSeconds"); param != "" {
+		if seconds, err := strconv.Atoi(param); err == nil {
+			replay.seconds = seconds
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ws := hub.add(conn, subs, replay)
+
+	// helpful log statement to show connections
+	log.Printf("Client Connected as WS %d\n", ws.id)
+}
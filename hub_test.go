@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const hubTestTimeout = 5 * time.Second
+
+// startHub swaps in a fresh hub and serves wsEndpoint for it.
+func startHub(t *testing.T, queueSize int, overflow string, backlogSize int) (*TwitchWSHub, *httptest.Server) {
+	t.Helper()
+	hub = newTwitchWSHub(queueSize, overflow, backlogSize)
+	server := httptest.NewServer(http.HandlerFunc(wsEndpoint))
+	t.Cleanup(server.Close)
+	return hub, server
+}
+
+func dialHub(t *testing.T, server *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws" + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dialing hub: %v", err)
+	}
+	return conn
+}
+
+// waitForClients waits until the hub has n clients, and returns them.
+func waitForClients(t *testing.T, h *TwitchWSHub, n int) []*TwitchWS {
+	t.Helper()
+	deadline := time.Now().Add(hubTestTimeout)
+	for {
+		h.mutex.Lock()
+		var clients []*TwitchWS
+		for _, ws := range h.clients {
+			clients = append(clients, ws)
+		}
+		h.mutex.Unlock()
+
+		if len(clients) == n {
+			return clients
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hub has %d clients, want %d", len(clients), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readHubMsg(t *testing.T, conn *websocket.Conn) TwitchWSMsg {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(hubTestTimeout))
+	_, p, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading from hub: %v", err)
+	}
+	var msg TwitchWSMsg
+	if err := json.Unmarshal(p, &msg); err != nil {
+		t.Fatalf("parsing hub message: %v", err)
+	}
+	return msg
+}
+
+func chatMsg(channel string, id string) TwitchWSMsg {
+	return TwitchWSMsg{MsgType: msgTypeMessage, Id: id, Channel: channel, Time: time.Now().Unix()}
+}
+
+// TestHubBroadcastWhileClientsComeAndGo is mostly for the race detector:
+// it broadcasts nonstop while clients connect, read a little and leave.
+func TestHubBroadcastWhileClientsComeAndGo(t *testing.T) {
+	h, server := startHub(t, 8, wsOverflowDrop, 16)
+
+	stop := make(chan struct{})
+	broadcasting := make(chan struct{})
+	go func() {
+		defer close(broadcasting)
+		for x := 0; ; x++ {
+			select {
+			case <-stop:
+				return
+			default:
+				h.broadcast(chatMsg("chan", fmt.Sprintf("msg-%d", x)))
+			}
+		}
+	}()
+
+	var clients sync.WaitGroup
+	for x := 0; x < 8; x++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for y := 0; y < 5; y++ {
+				url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?events=message"
+				conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					t.Errorf("dialing hub: %v", err)
+					return
+				}
+				conn.SetReadDeadline(time.Now().Add(hubTestTimeout))
+				for z := 0; z < 3; z++ {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						t.Errorf("reading from hub: %v", err)
+						break
+					}
+				}
+				conn.Close()
+			}
+		}()
+	}
+	clients.Wait()
+	close(stop)
+	<-broadcasting
+
+	waitForClients(t, h, 0)
+}
+
+// overflowHub connects a client and stalls its writer, then broadcasts until
+// the client's queue overflows.
+func overflowHub(t *testing.T, overflow string) (*TwitchWSHub, *TwitchWS, *websocket.Conn) {
+	t.Helper()
+	h, server := startHub(t, 2, overflow, 0)
+	conn := dialHub(t, server, "?events=message")
+	t.Cleanup(func() { conn.Close() })
+	ws := waitForClients(t, h, 1)[0]
+
+	// the writer can take at most one message out of the queue before it
+	// blocks on the write lock
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+
+	for x := 0; x < 10; x++ {
+		sentTo, total := h.broadcast(chatMsg("chan", fmt.Sprintf("msg-%d", x)))
+		if sentTo == 0 {
+			if overflow == wsOverflowDrop && total != 1 {
+				t.Fatalf("broadcast saw %d clients after dropping a message, want 1", total)
+			}
+			return h, ws, conn
+		}
+	}
+	t.Fatal("client queue never overflowed")
+	return nil, nil, nil
+}
+
+func TestHubOverflowDrop(t *testing.T) {
+	h, _, conn := overflowHub(t, wsOverflowDrop)
+
+	// the client stays connected, gets what was queued and then new messages
+	waitForClients(t, h, 1)
+	readHubMsg(t, conn)
+	for {
+		if sentTo, _ := h.broadcast(chatMsg("chan", "after")); sentTo == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		if msg := readHubMsg(t, conn); msg.Id == "after" {
+			break
+		}
+	}
+}
+
+func TestHubOverflowDisconnect(t *testing.T) {
+	h, ws, conn := overflowHub(t, wsOverflowDisconnect)
+
+	// the client is taken off the hub right away and its connection closed
+	waitForClients(t, h, 0)
+	select {
+	case <-ws.done:
+	default:
+		t.Fatal("overflowed client wasn't closed")
+	}
+	conn.SetReadDeadline(time.Now().Add(hubTestTimeout))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
+
+func TestSubscriptionWants(t *testing.T) {
+	shuffle := TwitchWSMsg{MsgType: msgTypeShuffle, Id: "shuffle-1"}
+	deletion := TwitchWSMsg{MsgType: msgTypeDelete, Id: "del-1", Channel: "#Foo"}
+
+	tests := []struct {
+		name     string
+		channels []string
+		events   []string
+		msg      TwitchWSMsg
+		want     bool
+	}{
+		{"everything", nil, nil, chatMsg("foo", "1"), true},
+		{"subscribed channel", []string{"foo"}, nil, chatMsg("foo", "1"), true},
+		{"other channel", []string{"foo"}, nil, chatMsg("bar", "1"), false},
+		{"channel case and hash", []string{"#FOO"}, nil, chatMsg("Foo", "1"), true},
+		{"no channel", []string{"foo"}, nil, shuffle, true},
+		{"subscribed event", nil, []string{"message"}, chatMsg("foo", "1"), true},
+		{"other event", nil, []string{"message"}, shuffle, false},
+		{"channel event", []string{"foo"}, []string{"delete"}, deletion, true},
+		{"channel event, other channel", []string{"bar"}, []string{"delete"}, deletion, false},
+		{"channel, other event", []string{"foo"}, []string{"delete"}, chatMsg("foo", "1"), false},
+	}
+	for _, test := range tests {
+		sub := &TwitchWSSubscription{}
+		if err := sub.set(test.channels, test.events); err != nil {
+			t.Fatalf("%s: set: %v", test.name, err)
+		}
+		if got := sub.wants(test.msg); got != test.want {
+			t.Errorf("%s: wants = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	sub := &TwitchWSSubscription{}
+	if err := sub.set(nil, []string{"nope"}); err == nil {
+		t.Error("set took an unknown event type")
+	}
+}
+
+// TestHubSubscription checks a subscription from the query string filters
+// what a client is sent.
+func TestHubSubscription(t *testing.T) {
+	h, server := startHub(t, 8, wsOverflowDrop, 0)
+	conn := dialHub(t, server, "?channels=foo&events=message")
+	defer conn.Close()
+	waitForClients(t, h, 1)
+
+	h.broadcast(chatMsg("bar", "bar-1"))
+	h.broadcast(TwitchWSMsg{MsgType: msgTypeShuffle, Id: "shuffle-1"})
+	h.broadcast(chatMsg("foo", "foo-1"))
+
+	if msg := readHubMsg(t, conn); msg.Id != "foo-1" {
+		t.Fatalf("client was sent %q, want foo-1", msg.Id)
+	}
+}
+
+// TestQueueWSMsgDoesNotBlock checks that server events are handed off without
+// waiting on the transmitter, even once its queue is full.
+func TestQueueWSMsgDoesNotBlock(t *testing.T) {
+	saved := wsBroadcast
+	wsBroadcast = make(chan TwitchWSMsg, 1)
+	defer func() { wsBroadcast = saved }()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for x := 0; x < 3; x++ {
+			broadcastShuffle(ShuffleResult{HistoryId: int64(x)})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(hubTestTimeout):
+		t.Fatal("broadcastShuffle blocked with nothing reading")
+	}
+	if msg := <-wsBroadcast; msg.Id != "shuffle-0" {
+		t.Fatalf("queued %q, want shuffle-0", msg.Id)
+	}
+}
+
+// TestHubReadLimit checks a client sending an oversized frame is dropped.
+func TestHubReadLimit(t *testing.T) {
+	h, server := startHub(t, 8, wsOverflowDrop, 0)
+	conn := dialHub(t, server, "")
+	defer conn.Close()
+	waitForClients(t, h, 1)
+
+	big := `{"type":"subscribe","channels":["` + strings.Repeat("a", wsMaxRequestSize) + `"]}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(big)); err != nil {
+		t.Fatalf("writing to hub: %v", err)
+	}
+	waitForClients(t, h, 0)
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// -------------=========== IMPORT
+
+const (
+	importFormatCsv  = "csv"
+	importFormatJson = "json"
+	importFormatText = "text"
+
+	importCreated = "created"
+	importSkipped = "skipped"
+	importErrored = "errored"
+)
+
+// importColumns are the game fields a CSV column can be mapped to. By default
+// each is read from the column with the same header, ignoring case.
+var importColumns = []string{"name", "displayName", "description", "weight", "status", "flags", "tags"}
+
+// STImportRow is the outcome of one game in an import. Row is the line the
+// game starts on in a text or CSV file, counting the header, or its place in a
+// JSON array. Both count from 1.
+type STImportRow struct {
+	Row     int    `json:"row"`
+	Name    string `json:"name"`
+	Outcome string `json:"outcome"`
+	Id      int64  `json:"id,omitempty"`
+	Message string `json:"msg,omitempty"`
+}
+
+type STImportResult struct {
+	ListId  int64         `json:"listId"`
+	Created int           `json:"created"`
+	Skipped int           `json:"skipped"`
+	Errored int           `json:"errored"`
+	Rows    []STImportRow `json:"rows"`
+}
+
+// importEntry is a game read from an import, or why it couldn't be read, and
+// where it was in the file.
+type importEntry struct {
+	game STGame
+	err  error
+	row  int
+}
+
+// importFormat works out the format of an import from the format parameter,
+// falling back on the content type.
+func importFormat(format string, contentType string) (string, error) {
+	if format == "" {
+		contentType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+		switch strings.ToLower(contentType) {
+		case "text/csv":
+			format = importFormatCsv
+		case "application/json":
+			format = importFormatJson
+		case "text/plain":
+			format = importFormatText
+		}
+	}
+	switch format = strings.ToLower(format); format {
+	case importFormatCsv, importFormatJson, importFormatText:
+		return format, nil
+	case "":
+		return "", fmt.Errorf("Import format not given; use csv, json or text")
+	default:
+		return "", fmt.Errorf("Unknown import format: %q", format)
+	}
+}
+
+// parseImportColumns reads a CSV column mapping such as
+// "name:Title,weight:Priority" into header names by field.
+func parseImportColumns(param string) (map[string]string, error) {
+	columns := map[string]string{}
+	for _, pair := range strings.Split(param, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Invalid column mapping: %q", pair)
+		}
+
+		field := ""
+		for _, column := range importColumns {
+			if strings.EqualFold(column, strings.TrimSpace(parts[0])) {
+				field = column
+			}
+		}
+		if field == "" {
+			return nil, fmt.Errorf("Unknown game field in column mapping: %q", parts[0])
+		}
+		columns[field] = strings.TrimSpace(parts[1])
+	}
+	return columns, nil
+}
+
+// parseImport reads the games out of an import. Problems with a single game
+// are kept with its entry; an error is only returned when the import as a
+// whole can't be read.
+func parseImport(format string, data []byte, columns map[string]string) ([]importEntry, error) {
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+
+	switch format {
+	case importFormatJson:
+		var raw []json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("Could not parse JSON: %q", err)
+		}
+		entries := make([]importEntry, len(raw))
+		for x, item := range raw {
+			entries[x].row = x + 1
+			if err := json.Unmarshal(item, &entries[x].game); err != nil {
+				entries[x].err = fmt.Errorf("Could not parse JSON: %q", err)
+			} else {
+				entries[x].err = entries[x].game.applyFlags(0)
+			}
+		}
+		return entries, nil
+
+	case importFormatCsv:
+		return parseImportCsv(data, columns)
+
+	default:
+		var entries []importEntry
+		for x, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				entries = append(entries, importEntry{game: STGame{Name: line}, row: x + 1})
+			}
+		}
+		return entries, nil
+	}
+}
+
+// csvLineReader hands out its data a line at a time. csv.Reader only reads
+// more once it's used up what it has, so after each record, line is the line
+// that record ended on.
+type csvLineReader struct {
+	data []byte
+	line int
+}
+
+func (r *csvLineReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := bytes.IndexByte(r.data, '\n') + 1
+	if n == 0 {
+		n = len(r.data)
+	}
+	if n > len(p) {
+		n = len(p)
+	} else {
+		r.line++
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// csvRecordLine works out the line a record started on from the line it
+// ended on, as quoted fields can run over several lines.
+func csvRecordLine(record []string, endLine int) int {
+	for _, field := range record {
+		endLine -= strings.Count(field, "\n")
+	}
+	return endLine
+}
+
+func parseImportCsv(data []byte, columns map[string]string) ([]importEntry, error) {
+	lines := &csvLineReader{data: data}
+	reader := csv.NewReader(lines)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not parse CSV: %q", err)
+	}
+
+	index := map[string]int{}
+	for _, field := range importColumns {
+		name := field
+		if mapped, ok := columns[field]; ok {
+			name = mapped
+		}
+		for x, column := range header {
+			if strings.EqualFold(strings.TrimSpace(column), name) {
+				index[field] = x
+				break
+			}
+		}
+		if _, ok := index[field]; !ok && columns[field] != "" {
+			return nil, fmt.Errorf("CSV has no %q column for %s", name, field)
+		}
+	}
+	if _, ok := index["name"]; !ok {
+		return nil, fmt.Errorf("CSV has no name column")
+	}
+
+	var entries []importEntry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not parse CSV: %q", err)
+		}
+
+		cell := func(field string) string {
+			if x, ok := index[field]; ok && x < len(record) {
+				return strings.TrimSpace(record[x])
+			}
+			return ""
+		}
+		entry := csvImportEntry(cell)
+		entry.row = csvRecordLine(record, lines.line)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// csvImportEntry builds a game from the cells of a CSV row.
+func csvImportEntry(cell func(field string) string) importEntry {
+	game := STGame{Name: cell("name")}
+	if value := cell("displayName"); value != "" {
+		game.DisplayName.Set(&value)
+	}
+	if value := cell("description"); value != "" {
+		game.Description.Set(&value)
+	}
+	if value := cell("weight"); value != "" {
+		weight, err := strconv.Atoi(value)
+		if err != nil {
+			return importEntry{game: game, err: fmt.Errorf("Invalid weight: %q", value)}
+		}
+		game.Weight.Set(&weight)
+	}
+	// status and flags both take bits or names. As in the API, a row with both
+	// has to have them agree
+	if value := cell("status"); value != "" {
+		status, err := parseFlags(value)
+		if err != nil {
+			return importEntry{game: game, err: err}
+		}
+		game.Status.Set(&status)
+	}
+	if value := cell("flags"); value != "" {
+		bits, err := parseFlags(value)
+		if err != nil {
+			return importEntry{game: game, err: err}
+		}
+		if status := game.Status.Get(); status == nil {
+			game.Status.Set(&bits)
+		} else if *status&knownFlags() != bits&knownFlags() {
+			return importEntry{game: game, err: fmt.Errorf("Status %d doesn't match the flags %q", *status, value)}
+		}
+	}
+	game.Tags = parseTagList(cell("tags"))
+	return importEntry{game: game}
+}
+
+// importGames adds the entries to a list in a single transaction. Games whose
+// name is already in the list, ignoring case, are skipped. Entries that can't
+// be added are reported and don't stop the rest; a database error rolls the
+// whole import back. The caller must hold dbAccessMutex.
+func importGames(listId int64, entries []importEntry) (STImportResult, error) {
+	result := STImportResult{ListId: listId, Rows: []STImportRow{}}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM lists WHERE listId = ?)`, listId).Scan(&exists); err != nil {
+		return result, err
+	}
+	if !exists {
+		return result, &apiError{fmt.Sprintf("List ID not found: %d", listId), http.StatusNotFound}
+	}
+
+	stmt := `SELECT gameName FROM games WHERE listId = ?`
+	rows, err := tx.Query(stmt, listId)
+	if err != nil {
+		fmt.Printf("%q: during query %s\n", err, stmt)
+		return result, err
+	}
+	names := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return result, err
+		}
+		names[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	stmt = `
+		INSERT INTO games (listId, gameName, displayName, description, weight, status)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	for _, entry := range entries {
+		game := entry.game
+		game.Name = strings.TrimSpace(game.Name)
+		row := STImportRow{Row: entry.row, Name: game.Name}
+
+		if entry.err == nil && game.Name == "" {
+			entry.err = fmt.Errorf("Missing game name")
+		}
+		if entry.err == nil {
+			entry.err = game.checkFields()
+		}
+
+		switch {
+		case entry.err != nil:
+			row.Outcome = importErrored
+			row.Message = entry.err.Error()
+			result.Errored++
+		case names[strings.ToLower(game.Name)]:
+			row.Outcome = importSkipped
+			row.Message = "Already in list"
+			result.Skipped++
+		default:
+			if game.Weight.Get() == nil {
+				weightDefault := 1
+				game.Weight.Set(&weightDefault)
+			}
+			if game.Status.Get() == nil {
+				statusDefault := 0
+				game.Status.Set(&statusDefault)
+			}
+
+			inserted, err := tx.Exec(stmt, listId, game.Name, game.DisplayName, game.Description,
+				game.Weight, game.Status)
+			if err != nil {
+				fmt.Printf("%q: during exec %s\n", err, stmt)
+				return result, err
+			}
+			row.Id, _ = inserted.LastInsertId()
+			if len(game.Tags) > 0 {
+				if err := tagGameTx(tx, row.Id, game.Tags, false); err != nil {
+					return result, err
+				}
+			}
+
+			names[strings.ToLower(game.Name)] = true
+			row.Outcome = importCreated
+			result.Created++
+		}
+		result.Rows = append(result.Rows, row)
+	}
+
+	return result, tx.Commit()
+}
+
+func importList(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: importList\n")
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Invalid ID: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	format, err := importFormat(query.Get("format"), r.Header.Get("Content-Type"))
+	if err != nil {
+		outputApiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	columns, err := parseImportColumns(query.Get("columns"))
+	if err != nil {
+		outputApiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Invalid data: %q", err), http.StatusBadRequest)
+		return
+	}
+	entries, err := parseImport(format, reqBody, columns)
+	if err != nil {
+		outputApiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	result, err := importGames(id, entries)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputErr(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// importCommand is the import subcommand:
+//
+//	shuffletron import [-format csv|json|text] [-columns name:Title,...] <listId> <file>
+//
+// The file can be - for stdin. Without -format, it's guessed from the file's
+// extension.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "csv, json or text; guessed from the file extension when not given")
+	columnParam := flags.String("columns", "", "map game fields to CSV headers, e.g. name:Title,weight:Priority")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: shuffletron import [-format csv|json|text] [-columns map] <listId> <file>")
+	}
+
+	listId, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid list ID: %q", flags.Arg(0))
+	}
+	path := flags.Arg(1)
+	if *format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv":
+			*format = importFormatCsv
+		case ".json":
+			*format = importFormatJson
+		case ".txt":
+			*format = importFormatText
+		}
+	}
+	if *format, err = importFormat(*format, ""); err != nil {
+		return err
+	}
+	columns, err := parseImportColumns(*columnParam)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	entries, err := parseImport(*format, data, columns)
+	if err != nil {
+		return err
+	}
+
+	if err := migrateDb(false); err != nil {
+		return err
+	}
+	dbAccessMutex.Lock()
+	result, err := importGames(listId, entries)
+	dbAccessMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, row := range result.Rows {
+		if row.Outcome == importCreated {
+			fmt.Printf("%d: %s %q (ID %d)\n", row.Row, row.Outcome, row.Name, row.Id)
+		} else {
+			fmt.Printf("%d: %s %q: %s\n", row.Row, row.Outcome, row.Name, row.Message)
+		}
+	}
+	fmt.Printf("Imported into list %d: %d created, %d skipped, %d errored\n",
+		listId, result.Created, result.Skipped, result.Errored)
+	return nil
+}
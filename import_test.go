@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImportRowNumbers(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+		want   []int
+	}{
+		{importFormatText, "one\n\ntwo\n   \nthree", []int{1, 3, 5}},
+		{importFormatText, "\r\none\r\n\r\ntwo\r\n", []int{2, 4}},
+		// the header is line 1, blank lines are skipped and a quoted name
+		// can run over two lines
+		{importFormatCsv, "name,weight\none,1\n\ntwo,2\n\"three\nlines\",3\nfour,4\n", []int{2, 4, 5, 7}},
+		{importFormatCsv, "name\r\none\r\n\r\ntwo", []int{2, 4}},
+		// longer than csv.Reader's buffer
+		{importFormatCsv, "name\n" + strings.Repeat("x", 10000) + "\n\ntwo\n", []int{2, 4}},
+		{importFormatJson, `[{"name":"one"},{"name":"two"}]`, []int{1, 2}},
+	}
+
+	for _, test := range tests {
+		entries, err := parseImport(test.format, []byte(test.data), nil)
+		if err != nil {
+			t.Errorf("%s %q: %v", test.format, test.data, err)
+			continue
+		}
+		var got []int
+		for _, entry := range entries {
+			got = append(got, entry.row)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %q: rows %v, want %v", test.format, test.data, got, test.want)
+		}
+	}
+}
@@ -3,10 +3,10 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
@@ -17,37 +17,86 @@ import (
 	"github.com/Thor-x86/nullable"
 	"github.com/gempir/go-twitch-irc/v2"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
 	"github.com/imdario/mergo"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type STConfig struct {
-	Port     int      `json:"port"`
-	Channels []string `json:"channels"`
+	Port          int      `json:"port"`
+	Channels      []string `json:"channels"`
+	CommandBadges []string `json:"commandBadges"`
+	// BotUsername and BotToken log the bot into Twitch chat so it can reply.
+	// Without them, chat is read anonymously.
+	BotUsername string `json:"botUsername,omitempty"`
+	BotToken    string `json:"botToken,omitempty"`
+	// WSQueueSize is how many messages can wait to be sent to each WS client.
+	// WSOverflow says what happens when a client's queue is full: "drop" skips
+	// the message for that client, "disconnect" closes the client.
+	WSQueueSize int    `json:"wsQueueSize"`
+	WSOverflow  string `json:"wsOverflow"`
+	// BacklogSize is how many recent chat messages are kept per channel to
+	// catch new WS clients up. BacklogSeconds is how far back they're caught
+	// up by default; 0 means the whole backlog.
+	BacklogSize    int `json:"backlogSize"`
+	BacklogSeconds int `json:"backlogSeconds"`
+	// EventSub turns on channel-points redemptions when set.
+	EventSub *STEventSubConfig `json:"eventSub,omitempty"`
+	// AutoShuffle lists the subs, raids and cheers that set off a shuffle.
+	AutoShuffle []STAutoShuffle `json:"autoShuffle,omitempty"`
+	// Emotes turns on BTTV, FFZ and 7TV emotes in chat when set.
+	Emotes *STEmoteConfig `json:"emotes,omitempty"`
+	// Filters keep chat off the overlay, by channel name. The "*" filter is
+	// for channels without one of their own.
+	Filters map[string]STChatFilter `json:"filters,omitempty"`
+}
+
+// STPublicConfig is the part of the config clients can read from
+// /stconfig.json. Anything else, like tokens and Twitch IDs, stays here.
+type STPublicConfig struct {
+	Port          int      `json:"port"`
+	Channels      []string `json:"channels"`
+	CommandBadges []string `json:"commandBadges"`
+}
+
+// publicConfig reads the config file afresh, as serving the file used to,
+// and picks out what clients can see.
+func publicConfig() STPublicConfig {
+	config := readConfig()
+	return STPublicConfig{
+		Port:          config.Port,
+		Channels:      config.Channels,
+		CommandBadges: config.CommandBadges,
+	}
 }
 
 const defaultPort = 42069
 const defaultChannel = "kewliomzx"
+const configFile = "./stconfig.json"
 
 var db *sql.DB
 
-var wsListMutex = &sync.Mutex{}
-var wsWriteMutex = &sync.Mutex{}
 var dbAccessMutex = &sync.Mutex{}
 
 // -------------============== TWITCHWS CLASS
 
-type TwitchWS struct {
-	msg  chan TwitchWSMsg
-	conn *websocket.Conn
-	id   int
-	open bool
+// wsBroadcast feeds twitchTransmitter, which sends everything it receives to
+// every open WS.
+var wsBroadcast chan TwitchWSMsg
+
+// wsBroadcastSize is how many messages can wait for twitchTransmitter.
+const wsBroadcastSize = 256
+
+// queueWSMsg hands a message to twitchTransmitter without waiting for it, for
+// callers that hold a lock or run on the chat client's callbacks. If the
+// transmitter is that far behind, the message is dropped.
+func queueWSMsg(msg TwitchWSMsg) {
+	select {
+	case wsBroadcast <- msg:
+	default:
+		fmt.Printf("WS broadcast queue is full, dropped %s\n", msg.Id)
+	}
 }
 
-var openWS []TwitchWS
-var wsId int
-
 type TwitchWSMsg struct {
 	MsgType     TwitchWSMsgType    `json:"msgType"`
 	Id          string             `json:"id"`
@@ -57,6 +106,16 @@ type TwitchWSMsg struct {
 	Message     string             `json:"msg"`
 	Time        int64              `json:"time"`
 	Emotes      []TwitchWSMsgEmote `json:"emotes"`
+	UserId      string             `json:"userId,omitempty"`
+	Badges      map[string]int     `json:"badges,omitempty"`
+	Bits        int                `json:"bits,omitempty"`
+	FirstMsg    bool               `json:"firstMsg,omitempty"`
+	Reply       *TwitchWSMsgReply  `json:"reply,omitempty"`
+	Duration    int                `json:"duration,omitempty"` // purge timeout in seconds; 0 is a ban
+	Shuffle     *ShuffleResult     `json:"shuffle,omitempty"`
+	Poll        *STPoll            `json:"poll,omitempty"`
+	Alert       *STAlert           `json:"alert,omitempty"`
+	Status      *STChatStatus      `json:"status,omitempty"`
 }
 
 type TwitchWSMsgType int
@@ -66,85 +125,50 @@ const (
 	msgTypeMessage
 	msgTypeAction
 	msgTypeDelete
+	msgTypeShuffle
+	msgTypePoll
+	msgTypePurge
+	msgTypeClear
+	msgTypeAlert
+	msgTypeStatus
 )
 
+// msgTypeNames are the event names clients subscribe to.
+var msgTypeNames = map[TwitchWSMsgType]string{
+	msgTypeMessage: "message",
+	msgTypeAction:  "action",
+	msgTypeDelete:  "delete",
+	msgTypeShuffle: "shuffle",
+	msgTypePoll:    "poll",
+	msgTypePurge:   "purge",
+	msgTypeClear:   "clear",
+	msgTypeAlert:   "alert",
+	msgTypeStatus:  "status",
+}
+
 type TwitchWSMsgEmote struct {
 	Name string `json:"name"`
 	Id   string `json:"id"`
+	// Provider and Url are only set for BTTV, FFZ and 7TV emotes
+	Provider  string                `json:"provider,omitempty"`
+	Url       string                `json:"url,omitempty"`
+	Positions []TwitchWSMsgEmotePos `json:"positions"`
 }
 
-func (ws TwitchWS) wsWriter() {
-	for {
-		msg := <-ws.msg
-		if !ws.open {
-			fmt.Println("Stopping wsWriter")
-			return
-		}
-
-		outMsg, err := json.Marshal(msg)
-		if err != nil {
-			log.Println("Error in marshall op:", err)
-		}
-
-		wsWriteMutex.Lock()
-		if err := ws.conn.WriteMessage(
-			websocket.TextMessage, []byte(outMsg),
-		); err != nil {
-			log.Println("Error in WS write op:", err)
-			wsWriteMutex.Unlock()
-			break
-		} else {
-			wsWriteMutex.Unlock()
-		}
-	}
-}
-
-// define a wsReader which will listen for
-// new messages being sent to our WebSocket
-// endpoint
-func (ws TwitchWS) wsReader() {
-	defer func() {
-		fmt.Println("Attempting to terminate WS goroutines")
-		ws.open = false
-		wsListMutex.Lock()
-		fmt.Println("Now delisting this WS")
-		delisted := false
-		for x, delWS := range openWS {
-			if delWS.id == ws.id {
-				fmt.Println("Found WS to delist")
-				delisted = true
-				openWS = append(openWS[:x], openWS[x+1:]...)
-			}
-		}
-		if !delisted {
-			fmt.Println("Didn't find WS to delist")
-		}
-		wsListMutex.Unlock()
-		if ws.msg != nil {
-			ws.msg <- TwitchWSMsg{}
-		}
-	}()
-
-	for {
-		// read in a message
-		messageType, p, err := ws.conn.ReadMessage()
-		if err != nil {
-			log.Println(err)
-			break
-		}
-		// print out that message for clarity
-		fmt.Println(string(p))
-
-		wsWriteMutex.Lock()
-		if err := ws.conn.WriteMessage(messageType, p); err != nil {
-			log.Println("Error in WS read op:", err)
-			wsWriteMutex.Unlock()
-			break
-		} else {
-			wsWriteMutex.Unlock()
-		}
+// TwitchWSMsgEmotePos is where an emote sits in a message, counted in Unicode
+// code points rather than bytes. End is inclusive, as Twitch sends it.
+type TwitchWSMsgEmotePos struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
 
-	}
+// TwitchWSMsgReply is the message a chat message replied to.
+type TwitchWSMsgReply struct {
+	Id          string `json:"id"`
+	UserId      string `json:"userId"`
+	Login       string `json:"login"`
+	DisplayName string `json:"displayName"`
+	Message     string `json:"msg"`
 }
 
 // -------------=========== UNIVERSAL API FUNCTIONS
@@ -155,6 +179,27 @@ func outputApiError(w http.ResponseWriter, errMsg string, errCode int) {
 	})
 }
 
+// apiError carries the HTTP status to report alongside an error from a helper
+// shared by several endpoints.
+type apiError struct {
+	msg    string
+	status int
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+// outputErr reports an error through outputApiError, with its status if it's
+// an apiError and as an internal error otherwise.
+func outputErr(w http.ResponseWriter, err error) {
+	if aerr, ok := err.(*apiError); ok {
+		outputApiError(w, aerr.msg, aerr.status)
+	} else {
+		outputApiError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // -------------=========== LISTS ENDPOINTS
 type STList struct {
 	Id   int64  `json:"id"`
@@ -343,17 +388,46 @@ func deleteList(w http.ResponseWriter, r *http.Request) {
 		DELETE FROM lists
 		WHERE listId = ?
 	`
+	// foreign keys aren't turned on, so the list's games, their tags and its
+	// history go in the same transaction rather than by cascade
+	dependentStmts := []string{
+		`DELETE FROM game_tags WHERE gameId IN (SELECT gameId FROM games WHERE listId = ?)`,
+		`DELETE FROM games WHERE listId = ?`,
+		`DELETE FROM shuffle_history WHERE listId = ?`,
+	}
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Error preparing query: %q", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
-	if result, err := db.Exec(stmt, id); err != nil {
+	if result, err := tx.Exec(stmt, id); err != nil {
 		fmt.Printf("%q: during query %s\n", err, stmt)
 		outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
 		return
 	} else if rowsAff, _ := result.RowsAffected(); rowsAff == 0 {
 		outputApiError(w, fmt.Sprintf("List ID not found: %d", id), http.StatusNotFound)
 		return
-	} else {
-		w.WriteHeader(http.StatusNoContent)
 	}
+	for _, dependentStmt := range dependentStmts {
+		if _, err := tx.Exec(dependentStmt, id); err != nil {
+			fmt.Printf("%q: during query %s\n", err, dependentStmt)
+			outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Error deleting list: %q", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // -------------=========== GAMES ENDPOINTS
@@ -365,17 +439,43 @@ type STGame struct {
 	Description nullable.String `json:"description"`
 	Weight      nullable.Int    `json:"weight"`
 	Status      nullable.Int    `json:"status"`
+	// Flags names the bits set in Status; see statusFlags
+	Flags []string `json:"flags"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// checkFields rejects values a game can't have. Creating, updating and
+// importing games all check with it, so they accept the same games.
+func (game STGame) checkFields() error {
+	if weight := game.Weight.Get(); weight != nil && *weight < 0 {
+		return fmt.Errorf("Invalid weight: %d", *weight)
+	}
+	if status := game.Status.Get(); status != nil && *status < 0 {
+		return fmt.Errorf("Invalid status: %d", *status)
+	}
+	return nil
+}
+
+// gameFilterClause reads the tags and excludeTags query parameters into an SQL
+// condition on the games table.
+func gameFilterClause(r *http.Request) (string, []interface{}) {
+	filter := ShuffleFilter{
+		Tags:        parseTagList(r.URL.Query().Get("tags")),
+		ExcludeTags: parseTagList(r.URL.Query().Get("excludeTags")),
+	}
+	return filter.whereClause()
 }
 
 func returnAllGames(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Endpoint hit: returnAllGames\n")
 
-	stmt := `SELECT * FROM games`
+	filterClause, filterArgs := gameFilterClause(r)
+	stmt := `SELECT * FROM games WHERE ` + filterClause
 
 	dbAccessMutex.Lock()
 	defer dbAccessMutex.Unlock()
 
-	rows, err := db.Query(stmt)
+	rows, err := db.Query(stmt, filterArgs...)
 	if err != nil {
 		fmt.Printf("%q: during query %s\n", err, stmt)
 		outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
@@ -398,6 +498,11 @@ func returnAllGames(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("%q: after exec %s\n", err, stmt)
 	}
 
+	if err := attachTags(games); err != nil {
+		outputApiError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	json.NewEncoder(w).Encode(games)
 }
 
@@ -410,12 +515,13 @@ func returnAllGamesInList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stmt := `SELECT * FROM games WHERE listId = ?`
+	filterClause, filterArgs := gameFilterClause(r)
+	stmt := `SELECT * FROM games WHERE listId = ? AND ` + filterClause
 
 	dbAccessMutex.Lock()
 	defer dbAccessMutex.Unlock()
 
-	rows, err := db.Query(stmt, id)
+	rows, err := db.Query(stmt, append([]interface{}{id}, filterArgs...)...)
 	if err != nil {
 		fmt.Printf("%q: during query %s\n", err, stmt)
 		outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
@@ -438,6 +544,11 @@ func returnAllGamesInList(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("%q: after exec %s\n", err, stmt)
 	}
 
+	if err := attachTags(games); err != nil {
+		outputApiError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	json.NewEncoder(w).Encode(games)
 }
 
@@ -471,7 +582,12 @@ func returnSingleGame(w http.ResponseWriter, r *http.Request) {
 				outputApiError(w, fmt.Sprintf("Error during exec: %q", err), http.StatusInternalServerError)
 			}
 		} else {
-			json.NewEncoder(w).Encode(game)
+			games := []STGame{game}
+			if err := attachTags(games); err != nil {
+				outputApiError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(games[0])
 		}
 	}
 }
@@ -490,6 +606,14 @@ func createNewGame(w http.ResponseWriter, r *http.Request) {
 			outputApiError(w, fmt.Sprintf("Could not parse JSON: %q", err), http.StatusBadRequest)
 			return
 		}
+		if err := game.applyFlags(0); err != nil {
+			outputApiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := game.checkFields(); err != nil {
+			outputApiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		stmt := `
 			INSERT INTO games (listId, gameName, displayName, description, weight, status)
@@ -509,21 +633,52 @@ func createNewGame(w http.ResponseWriter, r *http.Request) {
 		dbAccessMutex.Lock()
 		defer dbAccessMutex.Unlock()
 
-		result, err := db.Exec(stmt, game.ListId, game.Name, game.DisplayName, game.Description,
+		// the game and its tags go in together, so a game is never left
+		// half-made
+		tx, err := db.Begin()
+		if err != nil {
+			fmt.Printf("err: %v\n", err)
+			outputApiError(w, fmt.Sprintf("Error preparing query: %q", err), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec(stmt, game.ListId, game.Name, game.DisplayName, game.Description,
 			game.Weight, game.Status)
 		if err != nil {
 			fmt.Printf("err: %v\n", err)
 			outputApiError(w, fmt.Sprintf("Error preparing query: %q", err), http.StatusInternalServerError)
-		} else {
-			game.Id, _ = result.LastInsertId()
-			w.WriteHeader(http.StatusCreated)
-			json.NewEncoder(w).Encode(game)
+			return
+		}
+		game.Id, _ = result.LastInsertId()
+		if game.Tags != nil {
+			if err := tagGameTx(tx, game.Id, game.Tags, true); err != nil {
+				fmt.Printf("err: %v\n", err)
+				outputApiError(w, fmt.Sprintf("Error tagging game: %q", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			fmt.Printf("err: %v\n", err)
+			outputApiError(w, fmt.Sprintf("Error saving game: %q", err), http.StatusInternalServerError)
+			return
+		}
+
+		if game.Tags != nil {
+			games := []STGame{game}
+			if err := attachTags(games); err != nil {
+				outputApiError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			game = games[0]
 		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(game)
 	}
 }
 
 func updateGame(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("Endpoint hit: updateList\n")
+	fmt.Printf("Endpoint hit: updateGame\n")
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
@@ -551,7 +706,7 @@ func updateGame(w http.ResponseWriter, r *http.Request) {
 		var activeDisplayName string
 		if err := row.Scan(&gameRetrieve.Id, &gameRetrieve.ListId, &gameRetrieve.Name,
 			&gameRetrieve.DisplayName, &gameRetrieve.Description, &gameRetrieve.Weight,
-			&gameRetrieve.Weight, &activeDisplayName); err != nil {
+			&gameRetrieve.Status, &activeDisplayName); err != nil {
 			fmt.Printf("%q: during exec %s\n", err, stmt)
 			if err == sql.ErrNoRows {
 				outputApiError(w, fmt.Sprintf("Game ID not found: %d", id), http.StatusNotFound)
@@ -567,6 +722,38 @@ func updateGame(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			// mergo would copy the nullable fields over even when they were
+			// left out, so keep what's stored for any the update doesn't have
+			var present map[string]json.RawMessage
+			if err := json.Unmarshal(reqBody, &present); err != nil || present == nil {
+				outputApiError(w, "Could not parse JSON: expected an object", http.StatusBadRequest)
+				return
+			}
+			if _, ok := present["displayName"]; !ok {
+				gameUpdate.DisplayName = gameRetrieve.DisplayName
+			}
+			if _, ok := present["description"]; !ok {
+				gameUpdate.Description = gameRetrieve.Description
+			}
+			if _, ok := present["weight"]; !ok {
+				gameUpdate.Weight = gameRetrieve.Weight
+			}
+			storedStatus := 0
+			if status := gameRetrieve.Status.Get(); status != nil {
+				storedStatus = *status
+			}
+			if err := gameUpdate.applyFlags(storedStatus); err != nil {
+				outputApiError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, ok := present["status"]; !ok && gameUpdate.Flags == nil {
+				gameUpdate.Status = gameRetrieve.Status
+			}
+			if err := gameUpdate.checkFields(); err != nil {
+				outputApiError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
 			gameUpdate.Id = gameRetrieve.Id
 			err = mergo.Merge(&gameRetrieve, gameUpdate, mergo.WithOverride)
 			if err != nil {
@@ -586,7 +773,17 @@ func updateGame(w http.ResponseWriter, r *http.Request) {
 				WHERE gameId = ?
 			`
 
-			if result, err := db.Exec(stmt, gameRetrieve.ListId, gameRetrieve.Name, gameRetrieve.DisplayName,
+			// the fields and the tags are saved together, so a failed tag
+			// change doesn't leave half an update behind
+			tx, err := db.Begin()
+			if err != nil {
+				fmt.Printf("err: %v\n", err)
+				outputApiError(w, fmt.Sprintf("Error preparing query: %q", err), http.StatusInternalServerError)
+				return
+			}
+			defer tx.Rollback()
+
+			if result, err := tx.Exec(stmt, gameRetrieve.ListId, gameRetrieve.Name, gameRetrieve.DisplayName,
 				gameRetrieve.Description, gameRetrieve.Weight, gameRetrieve.Status,
 				gameRetrieve.Id); err != nil {
 
@@ -596,7 +793,26 @@ func updateGame(w http.ResponseWriter, r *http.Request) {
 				outputApiError(w, fmt.Sprintf("Game ID not found: %d", id), http.StatusNotFound)
 				return
 			} else {
-				json.NewEncoder(w).Encode(gameRetrieve)
+				// tags are only touched if the update has them; an empty
+				// array clears them
+				if gameUpdate.Tags != nil {
+					if err := tagGameTx(tx, gameRetrieve.Id, gameUpdate.Tags, true); err != nil {
+						fmt.Printf("err: %v\n", err)
+						outputApiError(w, fmt.Sprintf("Error tagging game: %q", err), http.StatusInternalServerError)
+						return
+					}
+				}
+				if err := tx.Commit(); err != nil {
+					fmt.Printf("err: %v\n", err)
+					outputApiError(w, fmt.Sprintf("Error saving game: %q", err), http.StatusInternalServerError)
+					return
+				}
+				games := []STGame{gameRetrieve}
+				if err := attachTags(games); err != nil {
+					outputApiError(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				json.NewEncoder(w).Encode(games[0])
 			}
 		}
 	}
@@ -615,208 +831,45 @@ func deleteGame(w http.ResponseWriter, r *http.Request) {
 		DELETE FROM games
 		WHERE gameId = ?
 	`
-
-	if result, err := db.Exec(stmt, id); err != nil {
-		fmt.Printf("%q: during query %s\n", err, stmt)
-		outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
-		return
-	} else if rowsAff, _ := result.RowsAffected(); rowsAff == 0 {
-		outputApiError(w, fmt.Sprintf("Game ID not found: %d", id), http.StatusNotFound)
-		return
-	} else {
-		w.WriteHeader(http.StatusNoContent)
-	}
-}
-
-// -------------=========== SHUFFLE ENDPOINTS
-func returnShuffleResult(w http.ResponseWriter, r *http.Request) {
-	type ShuffleList struct {
-		Id     int64
-		Weight int
-	}
-
-	type ShuffleResult struct {
-		Game             STGame   `json:"game"`
-		AnimationContent []string `json:"animContent"`
-	}
-
-	fmt.Printf("Endpoint hit: returnShuffleResult\n")
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		outputApiError(w, fmt.Sprintf("Invalid ID: %q", err), http.StatusBadRequest)
-		return
-	}
-
-	rng := rand.New(rand.NewSource(time.Now().Unix()))
-
-	initStmt := `SELECT gameId, weight FROM games WHERE listId = ? AND status & 1 = 0`
-	animStmt := `SELECT activeDisplayName FROM games WHERE listId = ? AND NOT gameId = ?`
-	resultStmt := `SELECT * FROM games WHERE gameId = ?`
+	tagStmt := `DELETE FROM game_tags WHERE gameId = ?`
 
 	dbAccessMutex.Lock()
 	defer dbAccessMutex.Unlock()
 
-	// first, retrieve the list of possibilities
-	optionRows, err := db.Query(initStmt, id)
+	tx, err := db.Begin()
 	if err != nil {
-		fmt.Printf("%q: during query %s\n", err, initStmt)
-		outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Error preparing query: %q", err), http.StatusInternalServerError)
 		return
 	}
-	defer optionRows.Close()
-
-	var options []ShuffleList
-	totalWeight := 0
-
-	for optionRows.Next() {
-		var newOption ShuffleList
-		if err := optionRows.Scan(&newOption.Id, &newOption.Weight); err != nil {
-			fmt.Printf("%q: during exec %s\n", err, initStmt)
-		}
-		options = append(options, newOption)
-		totalWeight += newOption.Weight
-	}
-
-	if err = optionRows.Err(); err != nil {
-		fmt.Printf("%q: after exec %s\n", err, initStmt)
-	}
+	defer tx.Rollback()
 
-	// then, pick one out of the list
-	pick := rng.Int() % totalWeight
-	resultId := -1
-	for _, scanOption := range options {
-		pick -= scanOption.Weight
-		if pick < 0 {
-			resultId = int(scanOption.Id)
-			break
-		}
-	}
-
-	if resultId == -1 {
-		outputApiError(w, "No result returned (boggle)", http.StatusInternalServerError)
-	}
-
-	// next, get titles from list for animation
-	animRows, err := db.Query(animStmt, id, resultId)
-	if err != nil {
-		fmt.Printf("%q: during query %s\n", err, animStmt)
+	if result, err := tx.Exec(stmt, id); err != nil {
+		fmt.Printf("%q: during query %s\n", err, stmt)
 		outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
 		return
+	} else if rowsAff, _ := result.RowsAffected(); rowsAff == 0 {
+		outputApiError(w, fmt.Sprintf("Game ID not found: %d", id), http.StatusNotFound)
+		return
 	}
-	defer animRows.Close()
-
-	var animList []string
-
-	for animRows.Next() {
-		var newAnim string
-		if err := animRows.Scan(&newAnim); err != nil {
-			fmt.Printf("%q: during exec %s\n", err, animStmt)
-		}
-		animList = append(animList, newAnim)
-	}
-
-	if err = animRows.Err(); err != nil {
-		fmt.Printf("%q: after exec %s\n", err, animStmt)
-	}
-
-	for len(animList) > 19 {
-		delIndex := rng.Int() % len(animList)
-		var newAnimList []string
-		for x, animItem := range animList {
-			if x != delIndex {
-				newAnimList = append(newAnimList, animItem)
-			}
-		}
-		animList = newAnimList
-	}
-
-	// finally, return the result
-	if resultRow := db.QueryRow(resultStmt, resultId); resultRow.Err() != nil {
-		err := resultRow.Err()
-		fmt.Printf("%q: during query %s\n", err, resultStmt)
+	if _, err := tx.Exec(tagStmt, id); err != nil {
+		fmt.Printf("%q: during query %s\n", err, tagStmt)
 		outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
-	} else {
-		var game STGame
-		var activeDisplayName string
-		if err := resultRow.Scan(&game.Id, &game.ListId, &game.Name, &game.DisplayName, &game.Description,
-			&game.Weight, &game.Status, &activeDisplayName); err != nil {
-			fmt.Printf("%q: during exec %s\n", err, resultStmt)
-			if err == sql.ErrNoRows {
-				outputApiError(w, fmt.Sprintf("Game ID not found: %d", id), http.StatusNotFound)
-			} else {
-				outputApiError(w, fmt.Sprintf("Error during exec: %q", err), http.StatusInternalServerError)
-			}
-		} else {
-			fmt.Printf("Game selected: %s\n", game.Name)
-			json.NewEncoder(w).Encode(ShuffleResult{
-				Game:             game,
-				AnimationContent: animList,
-			})
-		}
+		return
 	}
-}
-
-// -------------=========== MAIN CODE
-
-// We'll need to define an Upgrader
-// this will require a Read and Write buffer size
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
-func initDb() {
-	sqlStmt := `
-  CREATE TABLE IF NOT EXISTS lists (
-    listId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-    listName VARCHAR NOT NULL
-  );
-
-	CREATE TABLE IF NOT EXISTS games (
-    gameId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-    listId INTEGER NOT NULL,
-    gameName TEXT NOT NULL,
-    displayName TEXT DEFAULT NULL,
-    description TEXT DEFAULT NULL,
-    weight INTEGER NOT NULL DEFAULT 1,
-    status INTEGER NOT NULL DEFAULT 0,
-    activeDisplayName TEXT GENERATED ALWAYS AS (IFNULL(displayName, gameName)) VIRTUAL,
-		FOREIGN KEY (listId) REFERENCES lists(listId) ON UPDATE CASCADE ON DELETE CASCADE
-  );
-  `
-
-	dbAccessMutex.Lock()
-	_, err := db.Exec(sqlStmt)
-	if err != nil {
-		log.Panicf("%q: %s\n", err, sqlStmt)
+	if err := tx.Commit(); err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Error deleting game: %q", err), http.StatusInternalServerError)
 		return
 	}
-	dbAccessMutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func wsEndpoint(w http.ResponseWriter, r *http.Request) {
-	// TODO: look more into CORS
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	log.Println("WS connection request")
-
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-	}
+// -------------=========== MAIN CODE
 
-	// helpful log statement to show connections
-	log.Println("Client Connected")
+func handleReqs(config STConfig) {
+	port := config.Port
 
-	newWS := TwitchWS{nil, ws, wsId, true}
-	wsId++
-	go newWS.wsReader()
-	wsListMutex.Lock()
-	openWS = append(openWS, newWS)
-	wsListMutex.Unlock()
-}
-
-func handleReqs(port int) {
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/ws", wsEndpoint)
 
@@ -825,6 +878,9 @@ func handleReqs(port int) {
 	router.HandleFunc("/lists/{id}", deleteList).Methods("DELETE")
 	router.HandleFunc("/lists/{id}", updateList).Methods("PUT")
 	router.HandleFunc("/lists/{id}", returnSingleList)
+	router.HandleFunc("/lists/{id}/history", returnListHistory)
+	router.HandleFunc("/lists/{id}/import", importList).Methods("POST")
+	router.HandleFunc("/lists/{id}/export", exportList)
 
 	router.HandleFunc("/games", createNewGame).Methods("POST")
 	router.HandleFunc("/games", returnAllGames)
@@ -832,7 +888,31 @@ func handleReqs(port int) {
 	router.HandleFunc("/games/{id}", deleteGame).Methods("DELETE")
 	router.HandleFunc("/games/{id}", updateGame).Methods("PUT")
 	router.HandleFunc("/games/{id}", returnSingleGame)
+	router.HandleFunc("/games/{id}/tags", changeGameTags).Methods("PUT", "POST")
+	router.HandleFunc("/games/{id}/tags", returnGameTags)
+	router.HandleFunc("/games/{id}/tags/{tag}", removeGameTag).Methods("DELETE")
+
+	router.HandleFunc("/flags", returnAllFlags)
+
+	router.HandleFunc("/tags", createNewTag).Methods("POST")
+	router.HandleFunc("/tags", returnAllTags)
+	router.HandleFunc("/tags/{tag}", deleteTag).Methods("DELETE")
+	router.HandleFunc("/tags/{tag}", updateTag).Methods("PUT")
+	router.HandleFunc("/tags/{tag}", returnSingleTag)
+
+	router.HandleFunc("/polls", createNewPoll).Methods("POST")
+	router.HandleFunc("/polls/current", returnCurrentPoll)
+
+	router.HandleFunc("/status", returnChatStatus)
+
+	router.HandleFunc("/filters", returnChatFilters)
+	router.HandleFunc("/filters/reload", reloadChatFilters).Methods("POST")
+
+	router.HandleFunc("/backup", downloadBackup)
+	router.HandleFunc("/restore", uploadRestore).Methods("POST")
 
+	router.HandleFunc("/shuffle", returnMultiShuffleResult)
+	router.HandleFunc("/shuffle/replay/{id}", replayShuffleResult)
 	router.HandleFunc("/shuffle/{id}", returnShuffleResult)
 
 	router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -841,7 +921,7 @@ func handleReqs(port int) {
 			http.ServeFile(w, r, "./build/"+r.URL.Path[1:])
 		} else if strings.HasSuffix(r.RequestURI, "/stconfig.json") {
 			fmt.Println("Client requested config")
-			http.ServeFile(w, r, "./stconfig.json")
+			json.NewEncoder(w).Encode(publicConfig())
 		} else {
 			fmt.Println("req not found " + r.RequestURI + " - serving index instead")
 			http.ServeFile(w, r, "./build/index.html")
@@ -851,88 +931,211 @@ func handleReqs(port int) {
 	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(port), router))
 }
 
-func twitchHandler(twitchchat chan TwitchWSMsg, channels []string) {
-	client := twitch.NewAnonymousClient()
+// newTwitchClient logs into chat as the configured bot, or anonymously if
+// there isn't one.
+func newTwitchClient(config STConfig) (*twitch.Client, bool) {
+	if config.BotUsername == "" || config.BotToken == "" {
+		fmt.Println("No bot account configured; reading chat anonymously")
+		return twitch.NewAnonymousClient(), false
+	}
+
+	token := config.BotToken
+	if !strings.HasPrefix(token, "oauth:") {
+		token = "oauth:" + token
+	}
+	fmt.Printf("Logging into chat as %s\n", config.BotUsername)
+	return twitch.NewClient(config.BotUsername, token), true
+}
+
+func twitchHandler(twitchchat chan TwitchWSMsg, config STConfig) {
+	client := twitchClient
 
 	//defer client.Disconnect()
 
 	client.OnPrivateMessage(func(msg twitch.PrivateMessage) {
 		fmt.Printf("[%s] %s: %s\n", msg.Channel, msg.User.DisplayName, msg.Message)
-		if msg.Bits > 0 {
-			fmt.Printf("%s has given %d bit(s) to %s\n", msg.User.DisplayName, msg.Bits, msg.Channel)
+
+		if strings.HasPrefix(msg.Message, "!") && !handlePollVote(msg) {
+			handleChatCommand(msg, config.CommandBadges)
 		}
 
 		var outEmotes []TwitchWSMsgEmote
 		for _, inEmote := range msg.Emotes {
+			var positions []TwitchWSMsgEmotePos
+			for _, pos := range inEmote.Positions {
+				positions = append(positions, TwitchWSMsgEmotePos{pos.Start, pos.End})
+			}
 			outEmotes = append(outEmotes, TwitchWSMsgEmote{
-				Name: inEmote.Name,
-				Id:   inEmote.ID,
+				Name:      inEmote.Name,
+				Id:        inEmote.ID,
+				Positions: positions,
 			})
 		}
 
+		outEmotes = thirdPartyEmotes.annotate(msg.RoomID, msg.Message, outEmotes)
+
+		// /me messages come through with the ACTION wrapper already stripped
+		msgType := msgTypeMessage
+		if msg.Action {
+			msgType = msgTypeAction
+		}
+
+		var reply *TwitchWSMsgReply
+		if parentId := msg.Tags["reply-parent-msg-id"]; parentId != "" {
+			reply = &TwitchWSMsgReply{
+				Id:          parentId,
+				UserId:      msg.Tags["reply-parent-user-id"],
+				Login:       msg.Tags["reply-parent-user-login"],
+				DisplayName: msg.Tags["reply-parent-display-name"],
+				Message:     msg.Tags["reply-parent-msg-body"],
+			}
+		}
+
 		twitchchat <- TwitchWSMsg{
-			MsgType:     msgTypeMessage,
+			MsgType:     msgType,
 			Id:          msg.ID,
 			DisplayName: msg.User.DisplayName,
 			DisplayCol:  msg.User.Color,
+			UserId:      msg.User.ID,
+			Badges:      msg.User.Badges,
+			Bits:        msg.Bits,
+			FirstMsg:    msg.Tags["first-msg"] == "1",
+			Reply:       reply,
 			Channel:     msg.Channel,
 			Time:        msg.Time.Unix(),
 			Message:     msg.Message,
 			Emotes:      outEmotes,
 		}
+
+		if msg.Bits > 0 {
+			fmt.Printf("%s has given %d bit(s) to %s\n", msg.User.DisplayName, msg.Bits, msg.Channel)
+			alert := cheerAlert(msg)
+			twitchchat <- TwitchWSMsg{
+				MsgType: msgTypeAlert,
+				Id:      "alert-" + msg.ID,
+				Channel: msg.Channel,
+				Time:    msg.Time.Unix(),
+				Alert:   &alert,
+			}
+			autoShuffle(config.AutoShuffle, alert)
+		}
+	})
+
+	client.OnUserNoticeMessage(func(msg twitch.UserNoticeMessage) {
+		alert, ok := userNoticeAlert(msg)
+		if !ok {
+			return
+		}
+
+		fmt.Printf("[%s] %s\n", msg.Channel, msg.SystemMsg)
+		twitchchat <- TwitchWSMsg{
+			MsgType: msgTypeAlert,
+			Id:      msg.ID,
+			Channel: msg.Channel,
+			Time:    msg.Time.Unix(),
+			Alert:   &alert,
+		}
+		autoShuffle(config.AutoShuffle, alert)
 	})
 
 	client.OnClearMessage(func(msg twitch.ClearMessage) {
 		fmt.Printf("[%s] delete %s\n", msg.Channel, msg.TargetMsgID)
 		twitchchat <- TwitchWSMsg{
-			MsgType: msgTypeMessage,
+			MsgType: msgTypeDelete,
 			Id:      msg.TargetMsgID,
 			Channel: msg.Channel,
 			Message: msg.Message,
 		}
 	})
 
-	client.Join(channels...)
+	client.OnClearChatMessage(func(msg twitch.ClearChatMessage) {
+		if msg.TargetUserID == "" {
+			fmt.Printf("[%s] chat cleared\n", msg.Channel)
+			twitchchat <- TwitchWSMsg{
+				MsgType: msgTypeClear,
+				Channel: msg.Channel,
+				Time:    msg.Time.Unix(),
+			}
+			return
+		}
 
+		if msg.BanDuration > 0 {
+			fmt.Printf("[%s] %s timed out for %ds\n", msg.Channel, msg.TargetUsername, msg.BanDuration)
+		} else {
+			fmt.Printf("[%s] %s banned\n", msg.Channel, msg.TargetUsername)
+		}
+		twitchchat <- TwitchWSMsg{
+			MsgType:     msgTypePurge,
+			DisplayName: msg.TargetUsername,
+			UserId:      msg.TargetUserID,
+			Channel:     msg.Channel,
+			Time:        msg.Time.Unix(),
+			Duration:    msg.BanDuration,
+		}
+	})
+
+	client.OnConnect(func() {
+		setChatStatus(STChatStatus{Status: chatStatusConnected})
+	})
+
+	client.Join(config.Channels...)
+
+	// Connect only returns once the connection drops, so keep reconnecting,
+	// backing off while Twitch can't be reached
+	attempt := 0
 	for {
 		err := client.Connect()
-		if err == nil {
-			break
-		} else {
-			fmt.Println("Disconnected from Twitch: " + err.Error())
-			time.Sleep(5000)
+		if err == twitch.ErrClientDisconnected {
+			setChatStatus(STChatStatus{Status: chatStatusDisconnected})
+			return
+		}
+
+		lastError := "connection closed"
+		if err != nil {
+			lastError = err.Error()
+		}
+		fmt.Println("Disconnected from Twitch: " + lastError)
+
+		if currentChatStatus().Status == chatStatusConnected {
+			attempt = 0
 		}
+		delay := reconnectDelay(attempt)
+		attempt++
+		setChatStatus(STChatStatus{
+			Status:    chatStatusDisconnected,
+			Attempt:   attempt,
+			RetryAt:   time.Now().Add(delay).Unix(),
+			LastError: lastError,
+		})
+
+		time.Sleep(delay)
+		setChatStatus(STChatStatus{Status: chatStatusReconnecting, Attempt: attempt, LastError: lastError})
 	}
 }
 
 func twitchTransmitter(msg chan TwitchWSMsg) {
 	for {
 		msgIn := <-msg
-		sentTo := 0
-		wsListMutex.Lock()
-		for _, ws := range openWS {
-			if !ws.open {
-				continue
-			}
-			if ws.msg == nil {
-				ws.msg = make(chan TwitchWSMsg)
-				go ws.wsWriter()
-			}
-			ws.msg <- msgIn
-			sentTo++
+		if reason := filters.check(msgIn); reason != "" {
+			fmt.Printf("[%s] filtered %s's message (%s)\n", msgIn.Channel, msgIn.DisplayName, reason)
+			continue
 		}
-		fmt.Printf("Sent to %d/%d client(s)\n", sentTo, len(openWS))
-		wsListMutex.Unlock()
+		sentTo, total := hub.broadcast(msgIn)
+		fmt.Printf("Sent to %d/%d client(s)\n", sentTo, total)
 	}
 }
 
 func readConfig() STConfig {
 	defaultConfig := STConfig{
-		Port:     defaultPort,
-		Channels: []string{defaultChannel},
+		Port:          defaultPort,
+		Channels:      []string{defaultChannel},
+		CommandBadges: defaultCommandBadges,
+		WSQueueSize:   defaultWSQueueSize,
+		WSOverflow:    wsOverflowDrop,
+		BacklogSize:   defaultBacklogSize,
 	}
 
-	file, err := os.ReadFile("./stconfig.json")
+	file, err := os.ReadFile(configFile)
 	if err != nil {
 		fmt.Println("Failed to read stconfig.json")
 		return defaultConfig
@@ -953,14 +1156,84 @@ func readConfig() STConfig {
 		config.Channels = []string{defaultChannel}
 	}
 
+	if config.CommandBadges == nil {
+		config.CommandBadges = defaultCommandBadges
+	}
+
+	if config.WSQueueSize <= 0 {
+		config.WSQueueSize = defaultWSQueueSize
+	}
+
+	if config.WSOverflow != wsOverflowDisconnect {
+		config.WSOverflow = wsOverflowDrop
+	}
+
+	if config.BacklogSize == 0 {
+		config.BacklogSize = defaultBacklogSize
+	}
+
+	if config.EventSub != nil {
+		if config.EventSub.WebSocketUrl == "" {
+			config.EventSub.WebSocketUrl = defaultEventSubWSUrl
+		}
+		if config.EventSub.ApiUrl == "" {
+			config.EventSub.ApiUrl = defaultEventSubApiUrl
+		}
+		if config.EventSub.HoldSeconds == 0 {
+			config.EventSub.HoldSeconds = defaultRewardHold
+		}
+	}
+
+	if config.Emotes != nil {
+		if len(config.Emotes.Providers) == 0 {
+			config.Emotes.Providers = defaultEmoteProviders
+		}
+		var providers []string
+		for _, provider := range config.Emotes.Providers {
+			if _, ok := emoteSetFetchers[provider]; ok {
+				providers = append(providers, provider)
+			} else {
+				fmt.Printf("Unknown emote provider %q\n", provider)
+			}
+		}
+		config.Emotes.Providers = providers
+		if config.Emotes.BttvUrl == "" {
+			config.Emotes.BttvUrl = defaultBttvUrl
+		}
+		if config.Emotes.FfzUrl == "" {
+			config.Emotes.FfzUrl = defaultFfzUrl
+		}
+		if config.Emotes.SevenTvUrl == "" {
+			config.Emotes.SevenTvUrl = defaultSevenTvUrl
+		}
+		if config.Emotes.CacheDir == "" {
+			config.Emotes.CacheDir = defaultEmoteCacheDir
+		}
+		if config.Emotes.RefreshMinutes <= 0 {
+			config.Emotes.RefreshMinutes = defaultEmoteRefresh
+		}
+	}
+
 	return config
 }
 
-func main() {
-	fmt.Println("Starting server")
-	config := readConfig()
+// runSubcommand runs one of the command-line tools instead of the server.
+func runSubcommand(args []string) error {
+	switch args[0] {
+	case "import":
+		return importCommand(args[1:])
+	case "backup":
+		return backupCommand(args[1:])
+	case "restore":
+		return restoreCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q; the commands are: import, backup, restore", args[0])
+	}
+}
 
-	twitchchat := make(chan TwitchWSMsg)
+func main() {
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "check the pending database migrations, without applying them, and exit")
+	flag.Parse()
 
 	var err error
 	db, err = sql.Open("sqlite3", "./shuffletron.sqlite3")
@@ -968,9 +1241,55 @@ func main() {
 		log.Fatal(err)
 	}
 	defer db.Close()
-	initDb()
 
-	go twitchHandler(twitchchat, config.Channels)
-	go twitchTransmitter(twitchchat)
-	handleReqs(config.Port)
+	if *migrateDryRun {
+		if err := migrateDb(true); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// commands migrate for themselves, if they need to; backup mustn't, as it
+	// can run alongside the server
+	if flag.NArg() > 0 {
+		if err := runSubcommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// the lock is held for as long as the server runs
+	if _, err := lockServer(); err != nil {
+		log.Fatal(err)
+	}
+	if err := migrateDb(false); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Starting server")
+	config := readConfig()
+
+	wsBroadcast = make(chan TwitchWSMsg, wsBroadcastSize)
+	hub = newTwitchWSHub(config.WSQueueSize, config.WSOverflow, config.BacklogSize)
+	defaultBacklogSeconds = config.BacklogSeconds
+	twitchClient, twitchCanSpeak = newTwitchClient(config)
+	chatChannels = config.Channels
+	if err := filters.set(config.Filters); err != nil {
+		fmt.Printf("Failed to load chat filters: %v\n", err)
+	}
+
+	// chat reads thirdPartyEmotes, so it has to be set before anything starts
+	if config.Emotes != nil {
+		thirdPartyEmotes = newEmoteResolver(*config.Emotes)
+	}
+
+	go twitchHandler(wsBroadcast, config)
+	go twitchTransmitter(wsBroadcast)
+	if config.EventSub != nil {
+		go eventSubHandler(*config.EventSub)
+		go redemptionWorker(*config.EventSub)
+	}
+	if thirdPartyEmotes != nil {
+		go thirdPartyEmotes.refresher()
+	}
+	handleReqs(config)
 }
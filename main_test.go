@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// useTestDb swaps in a fresh, migrated database for the length of a test.
+func useTestDb(t *testing.T) {
+	t.Helper()
+	testDb, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "shuffletron.sqlite3"))
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	saved := db
+	db = testDb
+	t.Cleanup(func() {
+		db = saved
+		testDb.Close()
+	})
+
+	if err := migrateDb(false); err != nil {
+		t.Fatalf("migrating test database: %v", err)
+	}
+}
+
+// testExec runs statements against the test database, failing the test on an
+// error.
+func testExec(t *testing.T, stmt string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(stmt, args...); err != nil {
+		t.Fatalf("%s: %v", stmt, err)
+	}
+}
+
+// callApi sends a request through the router the server uses, and returns the
+// status and body.
+func callApi(t *testing.T, method string, path string, body string) (int, string) {
+	t.Helper()
+	router := mux.NewRouter().StrictSlash(true)
+	router.HandleFunc("/games/{id}", updateGame).Methods("PUT")
+	router.HandleFunc("/games/{id}", returnSingleGame)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	out, _ := ioutil.ReadAll(w.Result().Body)
+	return w.Code, string(out)
+}
+
+func TestUpdateGameStatusAndFlags(t *testing.T) {
+	useTestDb(t)
+	testExec(t, `INSERT INTO lists (listId, listName) VALUES (1, 'list')`)
+	// 8 is a bit no flag in the registry uses
+	testExec(t, `INSERT INTO games (gameId, listId, gameName, weight, status) VALUES (1, 1, 'game', 1, 8)`)
+
+	status := func() int {
+		code, body := callApi(t, "GET", "/games/1", "")
+		if code != http.StatusOK {
+			t.Fatalf("GET: %d %s", code, body)
+		}
+		var game struct {
+			Status int `json:"status"`
+		}
+		json.Unmarshal([]byte(body), &game)
+		return game.Status
+	}
+
+	tests := []struct {
+		name string
+		body string
+		code int
+		want int
+	}{
+		// a client that changed status but sent back the flags it was given
+		{"stale flags", `{"name":"game","status":9,"flags":[]}`, http.StatusBadRequest, 8},
+		{"status and flags agree", `{"name":"game","status":9,"flags":["played"]}`, http.StatusOK, 9},
+		{"flags keep unknown bits", `{"name":"game","flags":["multiplayer"]}`, http.StatusOK, 10},
+		{"status alone", `{"name":"game","status":1}`, http.StatusOK, 1},
+		{"neither", `{"name":"renamed"}`, http.StatusOK, 1},
+		{"unknown flag", `{"name":"game","flags":["nope"]}`, http.StatusBadRequest, 1},
+	}
+	for _, test := range tests {
+		if code, body := callApi(t, "PUT", "/games/1", test.body); code != test.code {
+			t.Errorf("%s: PUT gave %d %s, want %d", test.name, code, body, test.code)
+		}
+		if got := status(); got != test.want {
+			t.Errorf("%s: status is %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUpdateGameNeedsAnObject(t *testing.T) {
+	useTestDb(t)
+	testExec(t, `INSERT INTO lists (listId, listName) VALUES (1, 'list')`)
+	testExec(t, `INSERT INTO games (gameId, listId, gameName, weight, status) VALUES (1, 1, 'game', 2, 1)`)
+
+	for _, body := range []string{`null`, `[]`, `"game"`} {
+		if code, out := callApi(t, "PUT", "/games/1", body); code != http.StatusBadRequest {
+			t.Errorf("PUT %s gave %d %s, want 400", body, code, out)
+		}
+	}
+	if _, body := callApi(t, "GET", "/games/1", ""); !strings.Contains(body, `"weight":2`) {
+		t.Errorf("game changed after bad updates: %s", body)
+	}
+}
+
+func TestPublicConfig(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	write := func(config string) {
+		if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"port":1234,"channels":["one"],"botToken":"secret",` +
+		`"eventSub":{"clientId":"client","broadcasterId":"42","token":"secret"},` +
+		`"filters":{"*":{"blockedWords":["nope"]}}}`)
+	config := publicConfig()
+	if config.Port != 1234 {
+		t.Fatalf("public config has port %d, want 1234", config.Port)
+	}
+	out, _ := json.Marshal(config)
+	for _, hidden := range []string{"secret", "client", "42", "nope"} {
+		if strings.Contains(string(out), hidden) {
+			t.Errorf("public config has %q: %s", hidden, out)
+		}
+	}
+
+	// it's read when asked for, not when the server started
+	write(`{"port":1234,"channels":["two"]}`)
+	if config = publicConfig(); len(config.Channels) != 1 || config.Channels[0] != "two" {
+		t.Errorf("public config has channels %v, want [two]", config.Channels)
+	}
+}
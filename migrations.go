@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// -------------=========== MIGRATIONS
+
+// migration is one step of the schema. Migrations run in order, each in its
+// own transaction, and are never changed once released; add a new one
+// instead. A database's version is the number of migrations applied to it.
+type migration struct {
+	name string
+	up   func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	// databases made before migrations may already have any of these, so
+	// the early steps check before they change anything
+	{"create lists and games", execMigration(`
+		CREATE TABLE IF NOT EXISTS lists (
+			listId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			listName VARCHAR NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS games (
+			gameId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			listId INTEGER NOT NULL,
+			gameName TEXT NOT NULL,
+			displayName TEXT DEFAULT NULL,
+			description TEXT DEFAULT NULL,
+			weight INTEGER NOT NULL DEFAULT 1,
+			FOREIGN KEY (listId) REFERENCES lists(listId) ON UPDATE CASCADE ON DELETE CASCADE
+		);
+	`)},
+	{"add games.status", addColumnMigration("games", "status", `INTEGER NOT NULL DEFAULT 0`)},
+	{"add games.activeDisplayName", addColumnMigration("games", "activeDisplayName",
+		`TEXT GENERATED ALWAYS AS (IFNULL(displayName, gameName)) VIRTUAL`)},
+	{"create shuffle_history", execMigration(`
+		CREATE TABLE IF NOT EXISTS shuffle_history (
+			historyId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			listId INTEGER NOT NULL,
+			candidates TEXT NOT NULL,
+			seed INTEGER NOT NULL,
+			gameId INTEGER NOT NULL,
+			shuffledAt INTEGER NOT NULL,
+			FOREIGN KEY (listId) REFERENCES lists(listId) ON UPDATE CASCADE ON DELETE CASCADE
+		);
+
+		CREATE INDEX IF NOT EXISTS shuffle_history_list ON shuffle_history (listId, shuffledAt);
+	`)},
+	{"create tags", execMigration(`
+		CREATE TABLE tags (
+			tagId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			tagName TEXT NOT NULL UNIQUE COLLATE NOCASE
+		);
+
+		CREATE TABLE game_tags (
+			gameId INTEGER NOT NULL,
+			tagId INTEGER NOT NULL,
+			PRIMARY KEY (gameId, tagId),
+			FOREIGN KEY (gameId) REFERENCES games(gameId) ON UPDATE CASCADE ON DELETE CASCADE,
+			FOREIGN KEY (tagId) REFERENCES tags(tagId) ON UPDATE CASCADE ON DELETE CASCADE
+		);
+
+		CREATE INDEX game_tags_tag ON game_tags (tagId);
+	`)},
+}
+
+func execMigration(stmt string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(stmt)
+		return err
+	}
+}
+
+// addColumnMigration adds a column unless the table already has it. It checks
+// table_xinfo, as table_info leaves out generated columns.
+func addColumnMigration(table string, column string, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT name FROM pragma_table_xinfo(?)`, table)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+			if name == column {
+				return nil
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+		return err
+	}
+}
+
+// dbExecer is either the database or a transaction on it.
+type dbExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// schemaVersion makes sure the version table exists and returns how many
+// migrations the database has had.
+func schemaVersion(q dbExecer) (int, error) {
+	stmt := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER NOT NULL PRIMARY KEY,
+			name TEXT NOT NULL,
+			appliedAt INTEGER NOT NULL
+		);
+	`
+	if _, err := q.Exec(stmt); err != nil {
+		fmt.Printf("%q: during exec %s\n", err, stmt)
+		return 0, err
+	}
+
+	stmt = `SELECT IFNULL(MAX(version), 0) FROM schema_migrations`
+	var version int
+	if err := q.QueryRow(stmt).Scan(&version); err != nil {
+		fmt.Printf("%q: during query %s\n", err, stmt)
+		return 0, err
+	}
+	return version, nil
+}
+
+// migrateDb brings the database up to the latest schema. It won't touch a
+// database that's newer than this build. On a dry run, the pending
+// migrations are run in a single transaction that's then rolled back, to
+// check that they apply.
+func migrateDb(dryRun bool) error {
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+	return migrateDbLocked(dryRun)
+}
+
+// migrateDbLocked is migrateDb for a caller that already holds dbAccessMutex.
+func migrateDbLocked(dryRun bool) error {
+	var tx *sql.Tx
+	var version int
+	var err error
+	if dryRun {
+		if tx, err = db.Begin(); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		version, err = schemaVersion(tx)
+	} else {
+		version, err = schemaVersion(db)
+	}
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database is at schema version %d, but this build only knows up to %d; "+
+			"use a newer shuffletron", version, len(migrations))
+	}
+	if version == len(migrations) {
+		fmt.Printf("Database is up to date at schema version %d\n", version)
+		return nil
+	}
+
+	for x := version; x < len(migrations); x++ {
+		step := migrations[x]
+		fmt.Printf("Migrating to schema version %d: %s\n", x+1, step.name)
+
+		if !dryRun {
+			if tx, err = db.Begin(); err != nil {
+				return err
+			}
+		}
+		if err := applyMigration(tx, x+1, step); err != nil {
+			if !dryRun {
+				tx.Rollback()
+			}
+			return fmt.Errorf("migration %d (%s) failed: %v", x+1, step.name, err)
+		}
+		if !dryRun {
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("migration %d (%s) failed to commit: %v", x+1, step.name, err)
+			}
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("Dry run: %d migration(s) would be applied; nothing was changed\n", len(migrations)-version)
+	}
+	return nil
+}
+
+func applyMigration(tx *sql.Tx, version int, step migration) error {
+	if err := step.up(tx); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO schema_migrations (version, name, appliedAt) VALUES (?, ?, ?)`,
+		version, step.name, time.Now().Unix())
+	return err
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gempir/go-twitch-irc/v2"
+)
+
+// -------------=========== POLLS
+
+const (
+	defaultPollCount     = 3
+	maxPollCount         = 9
+	defaultPollDuration  = 60
+	defaultPollSubWeight = 1
+)
+
+// subscriberBadges mark a voter as a subscriber for the poll's sub weight.
+var subscriberBadges = []string{"subscriber", "founder"}
+
+type STPoll struct {
+	Id         int64    `json:"id"`
+	ListId     int64    `json:"listId"`
+	Candidates []STGame `json:"candidates"`
+	Tallies    []int    `json:"tallies"`
+	Voters     int      `json:"voters"`
+	SubWeight  int      `json:"subWeight"`
+	OpenedAt   int64    `json:"openedAt"`
+	ClosesAt   int64    `json:"closesAt"`
+	Open       bool     `json:"open"`
+	Winner     *STGame  `json:"winner,omitempty"`
+	HistoryId  int64    `json:"historyId,omitempty"`
+
+	// votes maps a voter's user ID to their vote
+	votes map[string]pollVote
+}
+
+type pollVote struct {
+	choice int
+	weight int
+}
+
+type STPollRequest struct {
+	ListId    int64 `json:"listId"`
+	Count     int   `json:"count"`
+	Duration  int   `json:"duration"`
+	SubWeight int   `json:"subWeight"`
+}
+
+var pollMutex = &sync.Mutex{}
+var currentPoll *STPoll
+var pollId int64
+
+// snapshot copies the poll so it can be sent off without holding pollMutex.
+// The caller must hold pollMutex.
+func (poll *STPoll) snapshot() *STPoll {
+	pollCopy := *poll
+	pollCopy.Candidates = append([]STGame(nil), poll.Candidates...)
+	pollCopy.Tallies = append([]int(nil), poll.Tallies...)
+	pollCopy.votes = nil
+	return &pollCopy
+}
+
+// broadcastPoll sends a snapshot of a poll to every open WS. Call it after
+// letting go of pollMutex, so votes never wait on the transmitter.
+func broadcastPoll(poll *STPoll) {
+	queueWSMsg(TwitchWSMsg{
+		MsgType: msgTypePoll,
+		Id:      fmt.Sprintf("poll-%d", poll.Id),
+		Time:    time.Now().Unix(),
+		Poll:    poll,
+	})
+}
+
+// handlePollVote counts a "!vote N" message towards the open poll. Returns
+// whether the message was a vote.
+func handlePollVote(msg twitch.PrivateMessage) bool {
+	args := strings.Fields(msg.Message)
+	if len(args) != 2 || strings.ToLower(args[0]) != "!vote" {
+		return false
+	}
+
+	choice, err := strconv.Atoi(args[1])
+	if err != nil {
+		return true
+	}
+
+	pollMutex.Lock()
+	poll := currentPoll
+	if poll == nil || !poll.Open || choice < 1 || choice > len(poll.Candidates) {
+		pollMutex.Unlock()
+		return true
+	}
+
+	weight := 1
+	for _, badge := range subscriberBadges {
+		if _, ok := msg.User.Badges[badge]; ok {
+			weight = poll.SubWeight
+			break
+		}
+	}
+
+	// one vote per user; voting again moves the vote
+	if previous, ok := poll.votes[msg.User.ID]; ok {
+		poll.Tallies[previous.choice-1] -= previous.weight
+	} else {
+		poll.Voters++
+	}
+	poll.votes[msg.User.ID] = pollVote{choice, weight}
+	poll.Tallies[choice-1] += weight
+	snapshot := poll.snapshot()
+	pollMutex.Unlock()
+
+	fmt.Printf("[%s] %s voted for %d\n", msg.Channel, msg.User.DisplayName, choice)
+	broadcastPoll(snapshot)
+	return true
+}
+
+// closePoll counts the votes and picks the winner. Ties are broken with a
+// weighted shuffle between the tied games, which is recorded in
+// shuffle_history like any other roll. pollMutex isn't held while the roll is
+// recorded, so votes never wait on the database.
+func closePoll(poll *STPoll) {
+	pollMutex.Lock()
+	if !poll.Open {
+		pollMutex.Unlock()
+		return
+	}
+	poll.Open = false
+
+	topTally := -1
+	var tied []ShuffleCandidate
+	for x, tally := range poll.Tallies {
+		if tally < topTally {
+			continue
+		}
+		if tally > topTally {
+			topTally = tally
+			tied = nil
+		}
+		weight := 1
+		if gameWeight := poll.Candidates[x].Weight.Get(); gameWeight != nil {
+			weight = *gameWeight
+		}
+		tied = append(tied, ShuffleCandidate{int64(x), weight})
+	}
+
+	seed := newSeed()
+	winnerIndex := pickCandidate(rand.New(rand.NewSource(seed)), tied)
+	if winnerIndex == -1 {
+		// every tied game has no weight; take the first
+		winnerIndex = tied[0].Id
+	}
+	winner := poll.Candidates[winnerIndex]
+
+	// record the tie-break against game IDs so it can be replayed
+	var historyCandidates []ShuffleCandidate
+	for _, candidate := range tied {
+		historyCandidates = append(historyCandidates,
+			ShuffleCandidate{poll.Candidates[candidate.Id].Id, candidate.Weight})
+	}
+	pollMutex.Unlock()
+
+	dbAccessMutex.Lock()
+	historyId, err := recordShuffle(winner.ListId, historyCandidates, seed, winner.Id, time.Now().Unix())
+	dbAccessMutex.Unlock()
+	if err != nil {
+		fmt.Printf("Couldn't record poll winner: %v\n", err)
+	}
+
+	pollMutex.Lock()
+	poll.Winner = &winner
+	poll.HistoryId = historyId
+	snapshot := poll.snapshot()
+	pollMutex.Unlock()
+
+	fmt.Printf("Poll %d won by %s with %d vote(s)\n", poll.Id, winner.Name, topTally)
+	broadcastPoll(snapshot)
+	chatAnnounce(fmt.Sprintf("The vote is in: %s", gameDisplayName(winner)))
+}
+
+func createNewPoll(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: createNewPoll\n")
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Invalid data: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	req := STPollRequest{
+		Count:     defaultPollCount,
+		Duration:  defaultPollDuration,
+		SubWeight: defaultPollSubWeight,
+	}
+	if err := json.Unmarshal(reqBody, &req); err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Could not parse JSON: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.Count < 2 || req.Count > maxPollCount {
+		outputApiError(w, fmt.Sprintf("Poll count must be between 2 and %d", maxPollCount), http.StatusBadRequest)
+		return
+	}
+	if req.Duration < 1 {
+		outputApiError(w, "Poll duration must be at least 1 second", http.StatusBadRequest)
+		return
+	}
+	if req.SubWeight < 1 {
+		outputApiError(w, "Poll sub weight must be at least 1", http.StatusBadRequest)
+		return
+	}
+
+	pollMutex.Lock()
+	pollOpen := currentPoll != nil && currentPoll.Open
+	pollMutex.Unlock()
+	if pollOpen {
+		outputApiError(w, "A poll is already open", http.StatusConflict)
+		return
+	}
+
+	// draw the candidates; they aren't picks, so only the winner goes in
+	// shuffle_history once the poll closes
+	opts := defaultShuffleOptions()
+	opts.Count = req.Count
+
+	dbAccessMutex.Lock()
+	result, _, err := drawLists([]int64{req.ListId}, opts)
+	dbAccessMutex.Unlock()
+
+	if err != nil {
+		outputErr(w, err)
+		return
+	}
+
+	candidates := result.Games
+	if len(candidates) < 2 {
+		outputApiError(w, fmt.Sprintf("Not enough games to vote on in list: %d", req.ListId), http.StatusNotFound)
+		return
+	}
+
+	pollMutex.Lock()
+	if currentPoll != nil && currentPoll.Open {
+		pollMutex.Unlock()
+		outputApiError(w, "A poll is already open", http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	pollId++
+	poll := &STPoll{
+		Id:         pollId,
+		ListId:     req.ListId,
+		Candidates: candidates,
+		Tallies:    make([]int, len(candidates)),
+		SubWeight:  req.SubWeight,
+		OpenedAt:   now.Unix(),
+		ClosesAt:   now.Add(time.Duration(req.Duration) * time.Second).Unix(),
+		Open:       true,
+		votes:      map[string]pollVote{},
+	}
+	currentPoll = poll
+	time.AfterFunc(time.Duration(req.Duration)*time.Second, func() { closePoll(poll) })
+	snapshot := poll.snapshot()
+	pollMutex.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snapshot)
+	broadcastPoll(snapshot)
+
+	var options []string
+	for x, candidate := range candidates {
+		options = append(options, fmt.Sprintf("%d: %s", x+1, gameDisplayName(candidate)))
+	}
+	chatAnnounce(fmt.Sprintf("Vote with !vote <number> (%ds) - %s", req.Duration, strings.Join(options, ", ")))
+}
+
+func returnCurrentPoll(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: returnCurrentPoll\n")
+
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+
+	if currentPoll == nil {
+		outputApiError(w, "No poll has been opened", http.StatusNotFound)
+	} else {
+		json.NewEncoder(w).Encode(currentPoll.snapshot())
+	}
+}
@@ -0,0 +1,869 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Thor-x86/nullable"
+	"github.com/gorilla/mux"
+)
+
+// -------------=========== SHUFFLE ENDPOINTS
+
+// maxSeed keeps generated seeds within the range a JavaScript number can hold
+// exactly, so the seed shown to the front-end can be sent back unchanged.
+const maxSeed = 1<<53 - 1
+
+type ShuffleCandidate struct {
+	Id     int64 `json:"id"`
+	Weight int   `json:"weight"`
+}
+
+// ShuffleFrame is one step of the reveal animation. Delay is how long, in
+// milliseconds, to show the frame before moving to the next one.
+type ShuffleFrame struct {
+	Text  string `json:"text"`
+	Delay int    `json:"delay"`
+}
+
+// ShuffleTimeline is the full reveal animation for a shuffle, so every display
+// shows the same sequence.
+type ShuffleTimeline struct {
+	Frames   []ShuffleFrame `json:"frames"`
+	Final    string         `json:"final"`
+	Duration int            `json:"duration"`
+}
+
+const (
+	timelineFrames   = 20
+	timelineMinDelay = 40
+	timelineMaxDelay = 300
+)
+
+type ShuffleResult struct {
+	Game             STGame          `json:"game"`
+	AnimationContent []string        `json:"animContent"`
+	Timeline         ShuffleTimeline `json:"timeline"`
+	Seed             int64           `json:"seed"`
+	HistoryId        int64           `json:"historyId"`
+	// Games and HistoryIds are only filled in when more than one game was
+	// asked for; Game and HistoryId always hold the first draw.
+	Games      []STGame `json:"games,omitempty"`
+	HistoryIds []int64  `json:"historyIds,omitempty"`
+	// Lists is only filled in when shuffling across several lists, and holds
+	// the lists the picked games came from.
+	Lists []STList `json:"lists,omitempty"`
+}
+
+type STShuffleHistory struct {
+	Id         int64              `json:"id"`
+	ListId     int64              `json:"listId"`
+	Candidates []ShuffleCandidate `json:"candidates"`
+	Seed       int64              `json:"seed"`
+	GameId     int64              `json:"gameId"`
+	GameName   string             `json:"gameName,omitempty"`
+	ShuffledAt int64              `json:"shuffledAt"`
+}
+
+// ShuffleOptions holds everything that can change how a shuffle is rolled.
+type ShuffleOptions struct {
+	Seed int64
+	// Count is how many distinct games to draw. Fewer are returned if the list
+	// runs out of candidates.
+	Count int
+	// Filter narrows down which games in the list can be picked.
+	Filter ShuffleFilter
+	// ListWeights multiplies the weight of every game in a list when shuffling
+	// across several lists. Lists not in the map keep their games' weights.
+	ListWeights map[int64]int
+	// CooldownPicks puts the last N games picked from the list on cooldown.
+	CooldownPicks int
+	// CooldownHours puts games picked from the list within the last X hours on
+	// cooldown.
+	CooldownHours float64
+	// CooldownMode is either cooldownExclude or cooldownReduce.
+	CooldownMode string
+	// CooldownFactor is the percentage of its weight a game on cooldown keeps
+	// in cooldownReduce mode.
+	CooldownFactor int
+}
+
+// ShuffleFilter narrows down the games a shuffle picks from.
+type ShuffleFilter struct {
+	// Include holds status bits a game must have set.
+	Include int
+	// Exclude holds status bits a game must have clear.
+	Exclude int
+	// Prefix matches the start of the game's display name, ignoring case.
+	Prefix    string
+	MinWeight nullable.Int
+	MaxWeight nullable.Int
+	// Tags must all be on the game; ExcludeTags must all be off it.
+	Tags        []string
+	ExcludeTags []string
+}
+
+// whereClause turns the filter into an SQL condition on the games table, along
+// with its arguments.
+func (f ShuffleFilter) whereClause() (string, []interface{}) {
+	clauses := []string{"status & ? = ?", "status & ? = 0"}
+	args := []interface{}{f.Include, f.Include, f.Exclude}
+
+	if f.Prefix != "" {
+		escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+		clauses = append(clauses, `activeDisplayName LIKE ? ESCAPE '\'`)
+		args = append(args, escaper.Replace(f.Prefix)+"%")
+	}
+	if minWeight := f.MinWeight.Get(); minWeight != nil {
+		clauses = append(clauses, "weight >= ?")
+		args = append(args, *minWeight)
+	}
+	if maxWeight := f.MaxWeight.Get(); maxWeight != nil {
+		clauses = append(clauses, "weight <= ?")
+		args = append(args, *maxWeight)
+	}
+	tagClauses, tagArgs := tagClause(f.Tags, f.ExcludeTags)
+	clauses = append(clauses, tagClauses...)
+	args = append(args, tagArgs...)
+
+	return strings.Join(clauses, " AND "), args
+}
+
+const (
+	cooldownExclude = "exclude"
+	cooldownReduce  = "reduce"
+)
+
+const defaultCooldownFactor = 25
+
+func newSeed() int64 {
+	return time.Now().UnixNano() & maxSeed
+}
+
+// defaultShuffleOptions returns the options for a plain shuffle with a new
+// seed.
+func defaultShuffleOptions() ShuffleOptions {
+	return ShuffleOptions{
+		Seed:           newSeed(),
+		Count:          1,
+		Filter:         ShuffleFilter{Exclude: defaultExcludeFlags()},
+		CooldownMode:   cooldownExclude,
+		CooldownFactor: defaultCooldownFactor,
+	}
+}
+
+// parseShuffleOptions reads the shuffle's query parameters. A new seed is
+// generated when none was given.
+func parseShuffleOptions(r *http.Request) (ShuffleOptions, error) {
+	query := r.URL.Query()
+	opts := defaultShuffleOptions()
+
+	var err error
+	if param := query.Get("seed"); param != "" {
+		if opts.Seed, err = strconv.ParseInt(param, 10, 64); err != nil {
+			return opts, fmt.Errorf("Invalid seed: %q", err)
+		}
+	}
+	if param := query.Get("count"); param != "" {
+		if opts.Count, err = strconv.Atoi(param); err != nil || opts.Count < 1 {
+			return opts, fmt.Errorf("Invalid count: %q", param)
+		}
+	}
+	// include and exclude take status flags by bits or by name
+	if param := query.Get("include"); param != "" {
+		if opts.Filter.Include, err = parseFlags(param); err != nil {
+			return opts, fmt.Errorf("Invalid include: %v", err)
+		}
+	}
+	if param := query.Get("exclude"); param != "" {
+		if opts.Filter.Exclude, err = parseFlags(param); err != nil {
+			return opts, fmt.Errorf("Invalid exclude: %v", err)
+		}
+	}
+	// only a conflict the caller asked for is an error; the default exclude
+	// gives way to whatever was included
+	if query.Get("exclude") == "" {
+		opts.Filter.Exclude &^= opts.Filter.Include
+	} else if opts.Filter.Include&opts.Filter.Exclude != 0 {
+		return opts, fmt.Errorf("Status bits both included and excluded: %d", opts.Filter.Include&opts.Filter.Exclude)
+	}
+	opts.Filter.Prefix = query.Get("prefix")
+	if param := query.Get("minWeight"); param != "" {
+		minWeight, err := strconv.Atoi(param)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid minWeight: %q", param)
+		}
+		opts.Filter.MinWeight.Set(&minWeight)
+	}
+	if param := query.Get("maxWeight"); param != "" {
+		maxWeight, err := strconv.Atoi(param)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid maxWeight: %q", param)
+		}
+		opts.Filter.MaxWeight.Set(&maxWeight)
+	}
+	opts.Filter.Tags = parseTagList(query.Get("tags"))
+	opts.Filter.ExcludeTags = parseTagList(query.Get("excludeTags"))
+	if param := query.Get("cooldownPicks"); param != "" {
+		if opts.CooldownPicks, err = strconv.Atoi(param); err != nil || opts.CooldownPicks < 0 {
+			return opts, fmt.Errorf("Invalid cooldownPicks: %q", param)
+		}
+	}
+	if param := query.Get("cooldownHours"); param != "" {
+		if opts.CooldownHours, err = strconv.ParseFloat(param, 64); err != nil || opts.CooldownHours < 0 {
+			return opts, fmt.Errorf("Invalid cooldownHours: %q", param)
+		}
+	}
+	if param := query.Get("cooldownMode"); param != "" {
+		if param != cooldownExclude && param != cooldownReduce {
+			return opts, fmt.Errorf("Invalid cooldownMode: %q", param)
+		}
+		opts.CooldownMode = param
+	}
+	if param := query.Get("cooldownFactor"); param != "" {
+		if opts.CooldownFactor, err = strconv.Atoi(param); err != nil ||
+			opts.CooldownFactor < 0 || opts.CooldownFactor > 100 {
+			return opts, fmt.Errorf("Invalid cooldownFactor: %q", param)
+		}
+	}
+
+	return opts, nil
+}
+
+// parseListIds reads the "lists" query parameter of a multi-list shuffle,
+// either a comma-separated list of IDs or "all". The caller must hold
+// dbAccessMutex.
+func parseListIds(param string) ([]int64, error) {
+	if param == "all" {
+		return allListIds()
+	}
+
+	var listIds []int64
+	for _, idParam := range strings.Split(param, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(idParam), 10, 64)
+		if err != nil {
+			return nil, &apiError{fmt.Sprintf("Invalid list ID: %q", idParam), http.StatusBadRequest}
+		}
+		listIds = append(listIds, id)
+	}
+	return listIds, nil
+}
+
+// parseListWeights reads the "listWeights" query parameter of a multi-list
+// shuffle, given as comma-separated listId:weight pairs.
+func parseListWeights(param string) (map[int64]int, error) {
+	listWeights := map[int64]int{}
+	if param == "" {
+		return listWeights, nil
+	}
+
+	for _, pair := range strings.Split(param, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid list weight: %q", pair)
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid list weight: %q", pair)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Invalid list weight: %q", pair)
+		}
+		listWeights[id] = weight
+	}
+	return listWeights, nil
+}
+
+// allListIds returns the ID of every list. The caller must hold dbAccessMutex.
+func allListIds() ([]int64, error) {
+	stmt := `SELECT listId FROM lists ORDER BY listId`
+
+	rows, err := db.Query(stmt)
+	if err != nil {
+		fmt.Printf("%q: during query %s\n", err, stmt)
+		return nil, fmt.Errorf("Error during query: %q", err)
+	}
+	defer rows.Close()
+
+	var listIds []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			fmt.Printf("%q: during exec %s\n", err, stmt)
+		}
+		listIds = append(listIds, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		fmt.Printf("%q: after exec %s\n", err, stmt)
+	}
+
+	return listIds, nil
+}
+
+// placeholders returns n comma-separated SQL placeholders, for IN clauses.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func int64Args(ids []int64) []interface{} {
+	args := make([]interface{}, len(ids))
+	for x, id := range ids {
+		args[x] = id
+	}
+	return args
+}
+
+// recentPicks returns the set of games in the lists that are on cooldown. The
+// caller must hold dbAccessMutex.
+func recentPicks(listIds []int64, opts ShuffleOptions) (map[int64]bool, error) {
+	picksStmt := `SELECT gameId FROM shuffle_history WHERE listId IN (` + placeholders(len(listIds)) +
+		`) ORDER BY historyId DESC LIMIT ?`
+	hoursStmt := `SELECT gameId FROM shuffle_history WHERE listId IN (` + placeholders(len(listIds)) +
+		`) AND shuffledAt >= ?`
+
+	recent := map[int64]bool{}
+	collect := func(stmt string, args ...interface{}) error {
+		rows, err := db.Query(stmt, args...)
+		if err != nil {
+			fmt.Printf("%q: during query %s\n", err, stmt)
+			return fmt.Errorf("Error during query: %q", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var gameId int64
+			if err := rows.Scan(&gameId); err != nil {
+				fmt.Printf("%q: during exec %s\n", err, stmt)
+			}
+			recent[gameId] = true
+		}
+		if err = rows.Err(); err != nil {
+			fmt.Printf("%q: after exec %s\n", err, stmt)
+		}
+		return nil
+	}
+
+	if opts.CooldownPicks > 0 {
+		if err := collect(picksStmt, append(int64Args(listIds), opts.CooldownPicks)...); err != nil {
+			return nil, err
+		}
+	}
+	if opts.CooldownHours > 0 {
+		since := time.Now().Add(-time.Duration(opts.CooldownHours * float64(time.Hour))).Unix()
+		if err := collect(hoursStmt, append(int64Args(listIds), since)...); err != nil {
+			return nil, err
+		}
+	}
+
+	return recent, nil
+}
+
+// applyCooldown drops or down-weights candidates that are on cooldown.
+func applyCooldown(candidates []ShuffleCandidate, recent map[int64]bool, opts ShuffleOptions) []ShuffleCandidate {
+	if len(recent) == 0 {
+		return candidates
+	}
+
+	var cooled []ShuffleCandidate
+	for _, candidate := range candidates {
+		if recent[candidate.Id] {
+			if opts.CooldownMode != cooldownReduce {
+				continue
+			}
+			reduced := candidate.Weight * opts.CooldownFactor / 100
+			if reduced < 1 && candidate.Weight > 0 && opts.CooldownFactor > 0 {
+				reduced = 1
+			}
+			candidate.Weight = reduced
+		}
+		cooled = append(cooled, candidate)
+	}
+	return cooled
+}
+
+// buildTimeline lays out the reveal animation, flicking through the animation
+// content and slowing down towards the final pick.
+func buildTimeline(rng *rand.Rand, animList []string, final string) ShuffleTimeline {
+	timeline := ShuffleTimeline{Final: final, Frames: []ShuffleFrame{}}
+	if len(animList) == 0 {
+		return timeline
+	}
+
+	last := -1
+	for x := 0; x < timelineFrames; x++ {
+		sel := rng.Int() % len(animList)
+		if sel == last && len(animList) > 1 {
+			sel = (sel + 1) % len(animList)
+		}
+		last = sel
+
+		// ease out: delays grow quadratically towards the end
+		progress := float64(x) / float64(timelineFrames-1)
+		delay := timelineMinDelay + int(float64(timelineMaxDelay-timelineMinDelay)*progress*progress)
+
+		timeline.Frames = append(timeline.Frames, ShuffleFrame{animList[sel], delay})
+		timeline.Duration += delay
+	}
+
+	return timeline
+}
+
+// pickCandidate makes a weighted pick from the candidate list. It must be the
+// first use of rng so that a stored seed and candidate list always reproduce
+// the same pick. Returns -1 if nothing could be picked.
+func pickCandidate(rng *rand.Rand, candidates []ShuffleCandidate) int64 {
+	totalWeight := 0
+	for _, candidate := range candidates {
+		totalWeight += candidate.Weight
+	}
+	if totalWeight <= 0 {
+		return -1
+	}
+
+	pick := rng.Int() % totalWeight
+	for _, candidate := range candidates {
+		pick -= candidate.Weight
+		if pick < 0 {
+			return candidate.Id
+		}
+	}
+	return -1
+}
+
+// recordShuffle adds a roll to shuffle_history and returns its ID. The caller
+// must hold dbAccessMutex.
+func recordShuffle(listId int64, candidates []ShuffleCandidate, seed int64, gameId int64,
+	shuffledAt int64) (int64, error) {
+	stmt := `
+		INSERT INTO shuffle_history (listId, candidates, seed, gameId, shuffledAt)
+		VALUES (?, ?, ?, ?, ?)
+	`
+
+	candidatesJson, err := json.Marshal(candidates)
+	if err != nil {
+		return 0, fmt.Errorf("Error encoding candidates: %q", err)
+	}
+
+	result, err := db.Exec(stmt, listId, string(candidatesJson), seed, gameId, shuffledAt)
+	if err != nil {
+		fmt.Printf("%q: during exec %s\n", err, stmt)
+		return 0, fmt.Errorf("Error recording shuffle: %q", err)
+	}
+	historyId, _ := result.LastInsertId()
+	return historyId, nil
+}
+
+// shuffleList picks games from the given list and records each draw in
+// shuffle_history. The caller must hold dbAccessMutex.
+func shuffleList(listId int, opts ShuffleOptions) (ShuffleResult, error) {
+	return shuffleLists([]int64{int64(listId)}, opts)
+}
+
+// shuffleLists picks games from across all of the given lists and records
+// each draw in shuffle_history under the list the game came from. The caller
+// must hold dbAccessMutex.
+func shuffleLists(listIds []int64, opts ShuffleOptions) (ShuffleResult, error) {
+	result, draws, err := drawLists(listIds, opts)
+	if err != nil {
+		return ShuffleResult{}, err
+	}
+
+	// record each draw so it can be replayed later
+	shuffledAt := time.Now().Unix()
+	for x, draw := range draws {
+		historyId, err := recordShuffle(result.Games[x].ListId, draw.candidates, draw.seed, draw.gameId, shuffledAt)
+		if err != nil {
+			return ShuffleResult{}, err
+		}
+		result.HistoryIds = append(result.HistoryIds, historyId)
+	}
+	result.HistoryId = result.HistoryIds[0]
+
+	if opts.Count == 1 {
+		result.Games = nil
+		result.HistoryIds = nil
+	}
+	return result, nil
+}
+
+// shuffleDraw is one game picked by a shuffle, with what it was picked from.
+type shuffleDraw struct {
+	gameId     int64
+	seed       int64
+	candidates []ShuffleCandidate
+}
+
+// drawLists picks games from across all of the given lists without recording
+// them, for shuffles that aren't a pick yet, like poll candidates. Games is
+// set even when only one game was drawn. The caller must hold dbAccessMutex.
+func drawLists(listIds []int64, opts ShuffleOptions) (ShuffleResult, []shuffleDraw, error) {
+	if len(listIds) == 0 {
+		return ShuffleResult{}, nil, &apiError{"No lists to shuffle", http.StatusNotFound}
+	}
+
+	filterClause, filterArgs := opts.Filter.whereClause()
+	initStmt := `SELECT gameId, listId, weight FROM games WHERE listId IN (` + placeholders(len(listIds)) +
+		`) AND ` + filterClause + ` ORDER BY gameId`
+	listStmt := `SELECT * FROM lists WHERE listId = ?`
+	resultStmt := `SELECT * FROM games WHERE gameId = ?`
+	seed := opts.Seed
+	rng := rand.New(rand.NewSource(seed))
+
+	// first, retrieve the list of possibilities
+	optionRows, err := db.Query(initStmt, append(int64Args(listIds), filterArgs...)...)
+	if err != nil {
+		fmt.Printf("%q: during query %s\n", err, initStmt)
+		return ShuffleResult{}, nil, fmt.Errorf("Error during query: %q", err)
+	}
+	defer optionRows.Close()
+
+	var options []ShuffleCandidate
+	for optionRows.Next() {
+		var newOption ShuffleCandidate
+		var optionListId int64
+		if err := optionRows.Scan(&newOption.Id, &optionListId, &newOption.Weight); err != nil {
+			fmt.Printf("%q: during exec %s\n", err, initStmt)
+		}
+		if listWeight, ok := opts.ListWeights[optionListId]; ok {
+			newOption.Weight *= listWeight
+		}
+		options = append(options, newOption)
+	}
+
+	if err = optionRows.Err(); err != nil {
+		fmt.Printf("%q: after exec %s\n", err, initStmt)
+	}
+
+	// drop or down-weight anything picked recently; what's stored in the
+	// history is the adjusted list, so replays still match
+	recent, err := recentPicks(listIds, opts)
+	if err != nil {
+		return ShuffleResult{}, nil, err
+	}
+	options = applyCooldown(options, recent, opts)
+
+	// then, pick out of the list; each draw after the first gets its own
+	// seed so every history entry can be replayed on its own
+	var draws []shuffleDraw
+	remaining := options
+	for len(draws) < opts.Count {
+		drawSeed := seed + int64(len(draws))
+		drawRng := rng
+		if len(draws) > 0 {
+			drawRng = rand.New(rand.NewSource(drawSeed))
+		}
+
+		pickedId := pickCandidate(drawRng, remaining)
+		if pickedId == -1 {
+			break
+		}
+		draws = append(draws, shuffleDraw{pickedId, drawSeed, remaining})
+
+		var nextRemaining []ShuffleCandidate
+		for _, candidate := range remaining {
+			if candidate.Id != pickedId {
+				nextRemaining = append(nextRemaining, candidate)
+			}
+		}
+		remaining = nextRemaining
+	}
+
+	if len(draws) == 0 {
+		return ShuffleResult{}, nil, &apiError{
+			fmt.Sprintf("No games available to shuffle in list: %s", joinIds(listIds)), http.StatusNotFound,
+		}
+	}
+
+	// next, get titles from list for animation
+	animStmt := `SELECT activeDisplayName FROM games WHERE listId IN (` + placeholders(len(listIds)) +
+		`) AND gameId NOT IN (` + placeholders(len(draws)) + `) ORDER BY gameId`
+	animArgs := int64Args(listIds)
+	for _, draw := range draws {
+		animArgs = append(animArgs, draw.gameId)
+	}
+
+	animRows, err := db.Query(animStmt, animArgs...)
+	if err != nil {
+		fmt.Printf("%q: during query %s\n", err, animStmt)
+		return ShuffleResult{}, nil, fmt.Errorf("Error during query: %q", err)
+	}
+	defer animRows.Close()
+
+	var animList []string
+
+	for animRows.Next() {
+		var newAnim string
+		if err := animRows.Scan(&newAnim); err != nil {
+			fmt.Printf("%q: during exec %s\n", err, animStmt)
+		}
+		animList = append(animList, newAnim)
+	}
+
+	if err = animRows.Err(); err != nil {
+		fmt.Printf("%q: after exec %s\n", err, animStmt)
+	}
+
+	for len(animList) > 19 {
+		delIndex := rng.Int() % len(animList)
+		var newAnimList []string
+		for x, animItem := range animList {
+			if x != delIndex {
+				newAnimList = append(newAnimList, animItem)
+			}
+		}
+		animList = newAnimList
+	}
+
+	// finally, get the results
+	result := ShuffleResult{
+		AnimationContent: animList,
+		Seed:             seed,
+	}
+	finalName := ""
+
+	for _, draw := range draws {
+		var game STGame
+		var activeDisplayName string
+		if err := db.QueryRow(resultStmt, draw.gameId).Scan(&game.Id, &game.ListId, &game.Name,
+			&game.DisplayName, &game.Description, &game.Weight, &game.Status, &activeDisplayName); err != nil {
+			fmt.Printf("%q: during exec %s\n", err, resultStmt)
+			if err == sql.ErrNoRows {
+				return ShuffleResult{}, nil, &apiError{
+					fmt.Sprintf("Game ID not found: %d", draw.gameId), http.StatusNotFound,
+				}
+			}
+			return ShuffleResult{}, nil, fmt.Errorf("Error during exec: %q", err)
+		}
+
+		if finalName == "" {
+			finalName = activeDisplayName
+		}
+
+		fmt.Printf("Game selected: %s (seed %d)\n", game.Name, draw.seed)
+		result.Games = append(result.Games, game)
+	}
+
+	if err := attachTags(result.Games); err != nil {
+		return ShuffleResult{}, nil, err
+	}
+	result.Game = result.Games[0]
+	result.Timeline = buildTimeline(rng, animList, finalName)
+
+	if len(listIds) > 1 {
+		seenLists := map[int64]bool{}
+		for _, game := range result.Games {
+			if seenLists[game.ListId] {
+				continue
+			}
+			seenLists[game.ListId] = true
+
+			var list STList
+			if err := db.QueryRow(listStmt, game.ListId).Scan(&list.Id, &list.Name); err != nil {
+				fmt.Printf("%q: during exec %s\n", err, listStmt)
+				return ShuffleResult{}, nil, fmt.Errorf("Error during exec: %q", err)
+			}
+			result.Lists = append(result.Lists, list)
+		}
+	}
+
+	return result, draws, nil
+}
+
+// broadcastShuffle sends a shuffle result to every open WS so that all
+// overlays can show the same roll. It doesn't block, so it's safe to call
+// while holding dbAccessMutex.
+func broadcastShuffle(result ShuffleResult) {
+	queueWSMsg(TwitchWSMsg{
+		MsgType: msgTypeShuffle,
+		Id:      fmt.Sprintf("shuffle-%d", result.HistoryId),
+		Time:    time.Now().Unix(),
+		Shuffle: &result,
+	})
+}
+
+func joinIds(ids []int64) string {
+	idStrings := make([]string, len(ids))
+	for x, id := range ids {
+		idStrings[x] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(idStrings, ", ")
+}
+
+func returnShuffleResult(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: returnShuffleResult\n")
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Invalid ID: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := parseShuffleOptions(r)
+	if err != nil {
+		outputApiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	if result, err := shuffleList(id, opts); err != nil {
+		outputErr(w, err)
+	} else {
+		json.NewEncoder(w).Encode(result)
+		broadcastShuffle(result)
+		chatAnnounce(fmt.Sprintf("Shuffled: %s", gameDisplayName(result.Game)))
+	}
+}
+
+func returnMultiShuffleResult(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: returnMultiShuffleResult\n")
+	query := r.URL.Query()
+	if query.Get("lists") == "" {
+		outputApiError(w, "No lists given to shuffle", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := parseShuffleOptions(r)
+	if err != nil {
+		outputApiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.ListWeights, err = parseListWeights(query.Get("listWeights")); err != nil {
+		outputApiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	listIds, err := parseListIds(query.Get("lists"))
+	if err != nil {
+		outputErr(w, err)
+		return
+	}
+
+	if result, err := shuffleLists(listIds, opts); err != nil {
+		outputErr(w, err)
+	} else {
+		json.NewEncoder(w).Encode(result)
+		broadcastShuffle(result)
+		chatAnnounce(fmt.Sprintf("Shuffled: %s", gameDisplayName(result.Game)))
+	}
+}
+
+// replayShuffleResult re-runs a recorded roll against its stored candidates
+// and seed, so anyone can check that the recorded game is what the seed picks.
+func replayShuffleResult(w http.ResponseWriter, r *http.Request) {
+	type ReplayResult struct {
+		History    STShuffleHistory `json:"history"`
+		ReplayedId int64            `json:"replayedId"`
+		Match      bool             `json:"match"`
+	}
+
+	fmt.Printf("Endpoint hit: replayShuffleResult\n")
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Invalid ID: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	stmt := `SELECT historyId, listId, candidates, seed, gameId, shuffledAt FROM shuffle_history WHERE historyId = ?`
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	var history STShuffleHistory
+	var candidates string
+	if err := db.QueryRow(stmt, id).Scan(&history.Id, &history.ListId, &candidates, &history.Seed,
+		&history.GameId, &history.ShuffledAt); err != nil {
+		fmt.Printf("%q: during exec %s\n", err, stmt)
+		if err == sql.ErrNoRows {
+			outputApiError(w, fmt.Sprintf("History ID not found: %d", id), http.StatusNotFound)
+		} else {
+			outputApiError(w, fmt.Sprintf("Error during exec: %q", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := json.Unmarshal([]byte(candidates), &history.Candidates); err != nil {
+		outputApiError(w, fmt.Sprintf("Could not parse stored candidates: %q", err), http.StatusInternalServerError)
+		return
+	}
+
+	replayedId := pickCandidate(rand.New(rand.NewSource(history.Seed)), history.Candidates)
+	json.NewEncoder(w).Encode(ReplayResult{
+		History:    history,
+		ReplayedId: replayedId,
+		Match:      replayedId == history.GameId,
+	})
+}
+
+func returnListHistory(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: returnListHistory\n")
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Invalid ID: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	limit := -1
+	if param := r.URL.Query().Get("limit"); param != "" {
+		if limit, err = strconv.Atoi(param); err != nil || limit < 0 {
+			outputApiError(w, fmt.Sprintf("Invalid limit: %q", param), http.StatusBadRequest)
+			return
+		}
+	}
+
+	stmt := `
+		SELECT h.historyId, h.listId, h.candidates, h.seed, h.gameId, g.activeDisplayName, h.shuffledAt
+		FROM shuffle_history h
+		LEFT JOIN games g ON g.gameId = h.gameId
+		WHERE h.listId = ?
+		ORDER BY h.historyId DESC
+		LIMIT ?
+	`
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	rows, err := db.Query(stmt, id, limit)
+	if err != nil {
+		fmt.Printf("%q: during query %s\n", err, stmt)
+		outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var history []STShuffleHistory
+	for rows.Next() {
+		var entry STShuffleHistory
+		var candidates string
+		var gameName sql.NullString
+		if err := rows.Scan(&entry.Id, &entry.ListId, &candidates, &entry.Seed, &entry.GameId,
+			&gameName, &entry.ShuffledAt); err != nil {
+			fmt.Printf("%q: during exec %s\n", err, stmt)
+		}
+		if err := json.Unmarshal([]byte(candidates), &entry.Candidates); err != nil {
+			fmt.Printf("%q: parsing candidates for history ID %d\n", err, entry.Id)
+		}
+		entry.GameName = gameName.String
+		history = append(history, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		fmt.Printf("%q: after exec %s\n", err, stmt)
+	}
+
+	json.NewEncoder(w).Encode(history)
+}
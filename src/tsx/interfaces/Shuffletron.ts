@@ -11,9 +11,55 @@ export interface STGame {
   description: string;
   weight: number;
   status: number;
+  flags?: string[];
+  tags?: string[];
+}
+
+export interface STFlag {
+  name: string;
+  bit: number;
+  description: string;
+  excludeByDefault: boolean;
+}
+
+export interface STTag {
+  id: number;
+  name: string;
+  games: number;
+}
+
+export interface STShuffleFrame {
+  text: string;
+  delay: number;
+}
+
+export interface STShuffleTimeline {
+  frames: STShuffleFrame[];
+  final: string;
+  duration: number;
 }
 
 export interface STShuffleResult {
   game: STGame;
   animContent: string[];
+  timeline: STShuffleTimeline;
+  seed: number;
+  historyId: number;
+  games?: STGame[];
+  historyIds?: number[];
+  lists?: STList[];
+}
+
+export interface STPoll {
+  id: number;
+  listId: number;
+  candidates: STGame[];
+  tallies: number[];
+  voters: number;
+  subWeight: number;
+  openedAt: number;
+  closesAt: number;
+  open: boolean;
+  winner?: STGame;
+  historyId?: number;
 }
\ No newline at end of file
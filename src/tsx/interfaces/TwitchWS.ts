@@ -1,3 +1,5 @@
+import { STPoll, STShuffleResult } from './Shuffletron';
+
 export interface TwitchWSMsg {
   msgType: TwitchWSMsgType;
   id: string;
@@ -7,16 +9,76 @@ export interface TwitchWSMsg {
   msg: string;
   time: number;
   emotes: TwitchWSMsgEmote[];
+  userId?: string;
+  badges?: { [badge: string]: number };
+  bits?: number;
+  firstMsg?: boolean;
+  reply?: TwitchWSMsgReply;
+  duration?: number;
+  shuffle?: STShuffleResult;
+  poll?: STPoll;
+  alert?: TwitchWSAlert;
+  status?: TwitchWSStatus;
+}
+
+export interface TwitchWSRequest {
+  type: 'subscribe';
+  channels?: string[];
+  events?: string[];
 }
 
 export interface TwitchWSMsgEmote {
   name: string;
   id: string;
+  // only set for BTTV, FFZ and 7TV emotes
+  provider?: 'bttv' | 'ffz' | '7tv';
+  url?: string;
+  positions: TwitchWSMsgEmotePos[];
+}
+
+// positions count code points, not UTF-16 units, and end is inclusive
+export interface TwitchWSMsgEmotePos {
+  start: number;
+  end: number;
+}
+
+// amount is months for subs, gifts for gifts, viewers for raids and bits for
+// cheers
+export interface TwitchWSAlert {
+  kind: 'sub' | 'resub' | 'subgift' | 'submysterygift' | 'raid' | 'cheer';
+  userName: string;
+  recipient?: string;
+  amount: number;
+  tier?: string;
+  msg?: string;
+  systemMsg?: string;
+}
+
+export interface TwitchWSStatus {
+  status: 'connecting' | 'connected' | 'disconnected' | 'reconnecting';
+  since: number;
+  attempt?: number;
+  retryAt?: number;
+  lastError?: string;
+}
+
+export interface TwitchWSMsgReply {
+  id: string;
+  userId: string;
+  login: string;
+  displayName: string;
+  msg: string;
 }
 
 export enum TwitchWSMsgType {
   Unknown,
   Message,
   Action,
-  Delete
+  Delete,
+  Shuffle,
+  Poll,
+  Purge,
+  Clear,
+  Alert,
+  Status
 }
\ No newline at end of file
@@ -5,7 +5,9 @@ import ColorHash from 'color-hash';
 import { Img } from 'react-image';
 import fontColorContrast from 'font-color-contrast';
 
-import { TwitchWSMsg, TwitchWSMsgEmote, TwitchWSMsgType } from '../interfaces/TwitchWS';
+import {
+  TwitchWSAlert, TwitchWSMsg, TwitchWSMsgEmote, TwitchWSMsgReply, TwitchWSMsgType, TwitchWSStatus
+} from '../interfaces/TwitchWS';
 import '../../css/Chat.css';
 import emotePlaceholder from '../../assets/emote-placeholder.png';
 
@@ -15,16 +17,53 @@ const { port } = window.location
 const deleteDelay = 30000;
 
 interface ChatItemProps {
+  userId?: string;
   displayName?: string;
   displayCol?: string;
   channel?: string;
   time?: DateTime;
   emotes?: TwitchWSMsgEmote[];
+  action?: boolean;
+  badges?: { [badge: string]: number };
+  bits?: number;
+  firstMsg?: boolean;
+  reply?: TwitchWSMsgReply;
   children?: string;
 }
 
+// renderEmotes swaps emotes into the message by position. Twitch counts
+// positions in code points, so the message is split into those rather than
+// indexed as a JS string.
+const renderEmotes = (msg: string, emotes: TwitchWSMsgEmote[], keyPrefix: string) => {
+  const chars = Array.from(msg);
+  const placed: { emote: TwitchWSMsgEmote, start: number, end: number }[] = [];
+  for (const emote of emotes) {
+    for (const pos of emote.positions ?? []) {
+      placed.push({ emote, start: pos.start, end: pos.end });
+    }
+  }
+  placed.sort((a, b) => a.start - b.start);
+
+  const displayMsg: ReactNode[] = [];
+  let next = 0;
+  for (const { emote, start, end } of placed) {
+    if (start < next || end >= chars.length) continue;
+    if (start > next) displayMsg.push(chars.slice(next, start).join(''));
+    displayMsg.push(<Img
+      key={`${keyPrefix}-emote-${start}`}
+      className='chatEmote'
+      src={[emote.url ?? `https://static-cdn.jtvnw.net/emoticons/v2/${emote.id}/default/dark/1.0`,
+        emotePlaceholder]}
+      alt={emote.name}
+    />);
+    next = end + 1;
+  }
+  if (next < chars.length) displayMsg.push(chars.slice(next).join(''));
+  return displayMsg;
+}
+
 const ChatItem: React.FC<ChatItemProps> = ({
-  displayName, displayCol, channel, time, emotes, children
+  displayName, displayCol, channel, time, emotes, action, badges, bits, firstMsg, reply, children
 }) => {
   const nameStyle: React.CSSProperties = {
     fontWeight: 'bold',
@@ -44,37 +83,55 @@ const ChatItem: React.FC<ChatItemProps> = ({
   const chatChannel = channel ? <span className='channelName' style={chanStyle}>
     {channel.slice(0, 3).toUpperCase()}
   </span> : null;
+  const chatBadges = badges ? Object.keys(badges).map(badge =>
+    <span key={badge} className={`chatBadge badge-${badge}`} title={`${badge}/${badges[badge]}`}>
+      {badge.slice(0, 1).toUpperCase()}
+    </span>
+  ) : null;
   const chatUser = displayName ? <span className='chatName' style={nameStyle}>
-    {displayName}:
+    {displayName}{action ? '' : ':'}
   </span> : null;
+  const chatBits = bits ? <span className='chatBits'>{bits} bits</span> : null;
+  const chatReply = reply ? <div className='chatReply'>
+    ↪ @{reply.displayName || reply.login}: {reply.msg}
+  </div> : null;
   const chatLineBreak = (chatTime || chatChannel) ? <br /> : null;
 
-  let displayMsg: ReactNode[] = children ? children.split(/\b/) : [];
-  if (emotes) for (const emote of emotes) {
-    let emoteCount = 0;
-    for (const x in displayMsg) {
-      if (typeof displayMsg[x] !== 'string') continue;
-      // TODO: check by regex instead (maybe don't need to after all?)
-
-      /*
-      const displayString = displayMsg[x]?.toString();
-      if (!displayString) continue;
-      if ((new RegExp(emote.name)).test(displayString)) {
-      */
-
-      if (displayMsg[x] === emote.name) {
-        displayMsg[x] = <Img
-          key={`emote-${time?.toMillis()}-${emote.name}-${++emoteCount}`}
-          className='chatEmote'
-          src={[`https://static-cdn.jtvnw.net/emoticons/v2/${emote.id}/default/dark/1.0`, emotePlaceholder]}
-          alt={emote.name}
-        />
-      }
-    }
+  const displayMsg = children ? renderEmotes(children, emotes ?? [], `${time?.toMillis()}`) : [];
+  // /me messages are shown in the user's colour
+  const msgStyle: React.CSSProperties | undefined = action ? { color: nameStyle.color } : undefined;
+
+  return <p className={firstMsg ? 'chatFirstMsg' : undefined}>
+    {chatTime} {chatChannel}{chatLineBreak}{chatReply}<div className='msgBody'>
+      {chatBadges}{chatUser} {chatBits} <span className={action ? 'chatAction' : undefined}
+        style={msgStyle}>{displayMsg}</span>
+    </div>
+  </p>
+}
+
+const alertText = (alert: TwitchWSAlert) => {
+  switch (alert.kind) {
+    case 'sub': return `${alert.userName} subscribed!`;
+    case 'resub': return `${alert.userName} resubscribed for ${alert.amount} months!`;
+    case 'subgift': return `${alert.userName} gifted a sub to ${alert.recipient}!`;
+    case 'submysterygift': return `${alert.userName} gifted ${alert.amount} subs!`;
+    case 'raid': return `${alert.userName} is raiding with ${alert.amount} viewers!`;
+    case 'cheer': return `${alert.userName} cheered ${alert.amount} bits!`;
   }
+}
 
-  return <p>
-    {chatTime} {chatChannel}{chatLineBreak}<div className='msgBody'>{chatUser} {displayMsg}</div>
+interface AlertItemProps {
+  channel?: string;
+  alert: TwitchWSAlert;
+}
+
+const AlertItem: React.FC<AlertItemProps> = ({ alert }) => {
+  // cheers already show up with their message in chat
+  const alertMsg = (alert.msg && alert.kind !== 'cheer') ?
+    <div className='msgBody'>{alert.msg}</div> : null;
+
+  return <p className={`chatAlert alert-${alert.kind}`}>
+    <span className='alertText'>{alertText(alert)}</span>{alertMsg}
   </p>
 }
 
@@ -84,6 +141,7 @@ interface ChatProps {
 interface ChatState {
   ws: Sockette;
   msgList: JSX.Element[];
+  chatStatus?: TwitchWSStatus;
 }
 export default class Chat extends React.Component<ChatProps, ChatState> {
   /*constructor(props: ChatProps) {
@@ -92,7 +150,8 @@ export default class Chat extends React.Component<ChatProps, ChatState> {
 
   componentDidMount() {
     this.setState({
-      ws: new Sockette(`ws://localhost:${port ?? '80'}/ws`, {
+      // pass along e.g. ?channels=a,b to only get those channels' chat
+      ws: new Sockette(`ws://localhost:${port ?? '80'}/ws${window.location.search}`, {
         timeout: 5000,
         maxAttempts: 10,
         onopen: e => console.log('Connected!', e),
@@ -119,14 +178,21 @@ export default class Chat extends React.Component<ChatProps, ChatState> {
     console.debug('Parsed content:', inMsg);
 
     switch (inMsg.msgType) {
-      case TwitchWSMsgType.Message: {
+      case TwitchWSMsgType.Message:
+      case TwitchWSMsgType.Action: {
         const msg = <ChatItem
           key={inMsg.id}
+          userId={inMsg.userId}
           displayName={inMsg.displayName}
           displayCol={inMsg.displayCol}
           time={DateTime.fromMillis(inMsg.time * 1000).toLocal()}
           channel={inMsg.channel}
           emotes={inMsg.emotes}
+          action={inMsg.msgType === TwitchWSMsgType.Action}
+          badges={inMsg.badges}
+          bits={inMsg.bits}
+          firstMsg={inMsg.firstMsg}
+          reply={inMsg.reply}
         >
           {inMsg.msg}
         </ChatItem>;
@@ -140,20 +206,53 @@ export default class Chat extends React.Component<ChatProps, ChatState> {
           })
         }, deleteDelay);
       } break;
+      case TwitchWSMsgType.Alert: {
+        if (!inMsg.alert) break;
+        const msg = <AlertItem key={inMsg.id} channel={inMsg.channel} alert={inMsg.alert} />;
+
+        newMsgList.push(msg);
+        this.setState({ msgList: newMsgList });
+
+        setTimeout(() => {
+          this.setState({
+            msgList: this.state.msgList.filter(i => i !== msg)
+          })
+        }, deleteDelay);
+      } break;
+      case TwitchWSMsgType.Status: {
+        this.setState({ chatStatus: inMsg.status });
+      } break;
       case TwitchWSMsgType.Delete: {
         console.debug('Deleting msg w/ id', inMsg.id);
         this.setState({
           msgList: msgList.filter((i: JSX.Element) => i.key !== inMsg.id)
         });
-      }
+      } break;
+      case TwitchWSMsgType.Purge: {
+        console.debug('Purging msgs from user', inMsg.displayName);
+        this.setState({
+          msgList: msgList.filter((i: JSX.Element) =>
+            i.props.userId !== inMsg.userId || i.props.channel !== inMsg.channel)
+        });
+      } break;
+      case TwitchWSMsgType.Clear: {
+        console.debug('Clearing chat for', inMsg.channel);
+        this.setState({
+          msgList: msgList.filter((i: JSX.Element) => i.props.channel !== inMsg.channel)
+        });
+      } break;
     }
   }
 
   render() {
     if (!this.state) return null;
-    const { msgList } = this.state;
+    const { msgList, chatStatus } = this.state;
+
+    const chatOffline = (chatStatus && chatStatus.status !== 'connected') ?
+      <p className='chatOffline'>chat offline</p> : null;
 
     return <div id='chat' className='multichat'>
+      {chatOffline}
       {msgList}
     </div>
   }
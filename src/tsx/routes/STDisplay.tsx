@@ -1,5 +1,7 @@
-import React, { useEffect, useState } from 'react';
+import React, { useCallback, useEffect, useRef, useState } from 'react';
+import Sockette from 'sockette';
 import { STList, STShuffleResult } from '../interfaces/Shuffletron';
+import { TwitchWSMsg, TwitchWSMsgType } from '../interfaces/TwitchWS';
 import useSound from 'use-sound';
 
 import '../../css/Shuffletron.css';
@@ -15,6 +17,9 @@ const STDisplay: React.FC = () => {
   const [shuffleAnim, setShuffleAnim] = useState(0);
   const [activeOp, setActiveOp] = useState(false);
   const [isBlink, setIsBlink] = useState(false);
+  // the shuffle being shown, so one that comes back from our own fetch and
+  // over the WS only plays once
+  const playingHistoryId = useRef<number | null>(null);
 
   const [playPick, {stop: stopPick}] = useSound('/sound/Decision1.mp3');
   const [playSel] = useSound('/sound/Decision2.mp3');
@@ -33,18 +38,44 @@ const STDisplay: React.FC = () => {
     setCurList((listList && listList.length > 0) ? listList[0].id : undefined);
   }, [listList]);
 
+  const playShuffle = useCallback((shuffle: STShuffleResult) => {
+    if (shuffle.historyId === playingHistoryId.current) return;
+    playingHistoryId.current = shuffle.historyId;
+    setIsBlink(false);
+    setActiveOp(true);
+    setError(null);
+    setResult(shuffle);
+    setShuffleAnim(shuffle.timeline.frames.length);
+  }, []);
+
+  // every shuffle is broadcast, whoever started it, so all overlays play the
+  // same timeline together
   useEffect(() => {
+    const ws = new Sockette(`ws://localhost:${port ?? '80'}/ws?events=shuffle`, {
+      timeout: 5000,
+      maxAttempts: 10,
+      onmessage: e => {
+        const inMsg = JSON.parse(e.data) as TwitchWSMsg;
+        if (inMsg.msgType === TwitchWSMsgType.Shuffle && inMsg.shuffle) playShuffle(inMsg.shuffle);
+      },
+      onerror: e => console.error('Error:', e)
+    });
+    return () => ws.close();
+  }, [playShuffle]);
+
+  useEffect(() => {
+    const { frames } = result?.timeline ?? { frames: [] };
+    const frame = frames[frames.length - shuffleAnim];
     const DoAnim = () => {
       if (!result) return;
-      const sel = Math.floor(Math.random() * result.animContent.length);
-      setError(result.animContent[sel]);
+      setError(frame.text);
       setShuffleAnim(shuffleAnim - 1);
       playPick();
     }
     if (!result) {
       if (shuffleAnim > 0) setShuffleAnim(0);
     }
-    else if (shuffleAnim > 0) setTimeout(DoAnim, 100);
+    else if (shuffleAnim > 0) setTimeout(DoAnim, frame.delay);
     else {
       stopPick();
       playSel();
@@ -73,11 +104,7 @@ const STDisplay: React.FC = () => {
         .then(r => r.json())
         .then(r => {
           if (r.err) throw new Error(r.err);
-          else {
-            setError(null);
-            setResult(r as STShuffleResult);
-            setShuffleAnim(20);
-          }
+          else playShuffle(r as STShuffleResult);
         })
         .catch((e: Error) => {
           setActiveOp(false);
@@ -96,7 +123,7 @@ const STDisplay: React.FC = () => {
     } else {
       setError('WAIT...')
       console.debug(`Marking ${result.game.name} as played...`);
-      result.game.status |= 1;
+      result.game.flags = (result.game.flags ?? []).filter(i => i !== 'played').concat('played');
       setActiveOp(true);
       fetch(`http://localhost:${port}/games/${result.game.id}`, {
         method: 'PUT',
@@ -1,5 +1,5 @@
 import React, { ChangeEvent, useEffect, useState } from 'react';
-import { STGame, STList } from '../../interfaces/Shuffletron';
+import { STFlag, STGame, STList } from '../../interfaces/Shuffletron';
 
 const MinWeight = 1;
 const MaxWeight = 25000;
@@ -15,12 +15,12 @@ const STGameEntry: React.FC<STGameEntryProps> = ({ setStatus }) => {
   const [displayName, setDisplayName] = useState('');
   const [description, setDescription] = useState('');
   const [weight, setWeight] = useState(1);
-  const [statusPlayed, setStatusPlayed] = useState(false);
-  const [statusMultiplayer, setStatusMultiplayer] = useState(false);
+  const [flags, setFlags] = useState<string[]>([]);
   const [delGame, setDelGame] = useState(0);
 
   const [listList, setListList] = useState<STList[] | undefined>();
   const [gameList, setGameList] = useState<STGame[] | undefined>();
+  const [flagList, setFlagList] = useState<STFlag[] | undefined>();
 
   const [activeOp, setActiveOp] = useState(false);
 
@@ -40,6 +40,16 @@ const STGameEntry: React.FC<STGameEntryProps> = ({ setStatus }) => {
       });
   }, [setStatus]);
 
+  useEffect(() => {
+    fetch(`http://localhost:${port}/flags`)
+      .then(r => r.json())
+      .then(r => setFlagList(r as STFlag[]))
+      .catch((e: Error) => {
+        console.error(e);
+        setStatus(`Error getting status flags: ${e.message}`);
+      });
+  }, [setStatus]);
+
   useEffect(() => {
     if (listList) {
       const curListName = listList.reduce((r, i) => i.id === curList ? i.name : r, '');
@@ -81,12 +91,11 @@ const STGameEntry: React.FC<STGameEntryProps> = ({ setStatus }) => {
     setWeight(isNaN(newWeight) ? 1 : Math.min(MaxWeight, Math.max(MinWeight, newWeight)));
   }
 
-  const onGameAddPlayedChange = ({ currentTarget }: ChangeEvent<HTMLInputElement>) => {
-    setStatusPlayed(currentTarget.checked);
-  }
-
-  const onGameAddMultiplayerChange = ({ currentTarget }: ChangeEvent<HTMLInputElement>) => {
-    setStatusMultiplayer(currentTarget.checked);
+  const onGameAddFlagChange = ({ currentTarget }: ChangeEvent<HTMLInputElement>) => {
+    const flag = currentTarget.value;
+    setFlags(currentTarget.checked
+      ? flags.filter(i => i !== flag).concat(flag)
+      : flags.filter(i => i !== flag));
   }
 
   const onGameAdd = () => {
@@ -106,9 +115,7 @@ const STGameEntry: React.FC<STGameEntryProps> = ({ setStatus }) => {
       };
       if (displayName) newGame.displayName = displayName;
       if (description) newGame.description = description;
-      newGame.status = 0;
-      if (statusPlayed) newGame.status |= 1;
-      if (statusMultiplayer) newGame.status |= 2;
+      newGame.flags = flags;
 
       fetch(`http://localhost:${port}/games`, {
         method: 'POST',
@@ -137,8 +144,7 @@ const STGameEntry: React.FC<STGameEntryProps> = ({ setStatus }) => {
     setDisplayName('');
     setDescription('');
     setWeight(1);
-    setStatusPlayed(false);
-    setStatusMultiplayer(false);
+    setFlags([]);
     setActiveOp(false);
   }
 
@@ -222,22 +228,18 @@ const STGameEntry: React.FC<STGameEntryProps> = ({ setStatus }) => {
       </p>
       <p>Status:</p>
       <ul>
-      <li>
-          <label>
-            <input type='checkbox'
-              checked={statusPlayed}
-              onChange={onGameAddPlayedChange}
-            /> Played
-          </label>
-        </li>
-        <li>
-          <label>
-            <input type='checkbox'
-              checked={statusMultiplayer}
-              onChange={onGameAddMultiplayerChange}
-            /> Played
-          </label>
-        </li>
+        {flagList
+          ? flagList.map(i => <li key={`flag-${i.name}`}>
+            <label title={i.description}>
+              <input type='checkbox'
+                value={i.name}
+                checked={flags.includes(i.name)}
+                onChange={onGameAddFlagChange}
+              /> {i.name}
+            </label>
+          </li>)
+          : <li>Loading...</li>
+        }
       </ul>
       <p>
         <button onClick={onGameAdd}>Add</button>&nbsp;
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// -------------=========== CHAT STATUS
+
+const (
+	chatStatusConnecting   = "connecting"
+	chatStatusConnected    = "connected"
+	chatStatusDisconnected = "disconnected"
+	chatStatusReconnecting = "reconnecting"
+
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = 2 * time.Minute
+)
+
+// STChatStatus is the state of the connection to Twitch chat.
+type STChatStatus struct {
+	Status string `json:"status"`
+	Since  int64  `json:"since"`
+	// Attempt counts the reconnects tried since chat was last connected, and
+	// RetryAt is when the next one will be.
+	Attempt   int    `json:"attempt,omitempty"`
+	RetryAt   int64  `json:"retryAt,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// reconnectRand jitters reconnects. It's only used by twitchHandler.
+var reconnectRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+var chatStatusMutex = &sync.Mutex{}
+var chatStatus = STChatStatus{Status: chatStatusConnecting, Since: time.Now().Unix()}
+
+// setChatStatus records a change of connection state and tells WS clients
+// about it. It's called from the chat client's callbacks, so it mustn't block.
+func setChatStatus(status STChatStatus) {
+	status.Since = time.Now().Unix()
+
+	chatStatusMutex.Lock()
+	chatStatus = status
+	chatStatusMutex.Unlock()
+
+	fmt.Printf("Twitch chat %s\n", status.Status)
+	queueWSMsg(chatStatusMsg(status))
+}
+
+func currentChatStatus() STChatStatus {
+	chatStatusMutex.Lock()
+	defer chatStatusMutex.Unlock()
+	return chatStatus
+}
+
+func chatStatusMsg(status STChatStatus) TwitchWSMsg {
+	return TwitchWSMsg{
+		MsgType: msgTypeStatus,
+		Id:      fmt.Sprintf("status-%d", status.Since),
+		Time:    status.Since,
+		Status:  &status,
+	}
+}
+
+// reconnectDelay backs off exponentially with each attempt, up to
+// reconnectMaxDelay. The second half of each delay is random, so a crowd of
+// clients doesn't all come back at once.
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		if backoff := reconnectBaseDelay << uint(attempt); backoff < delay {
+			delay = backoff
+		}
+	}
+	return delay/2 + time.Duration(reconnectRand.Int63n(int64(delay/2)+1))
+}
+
+func returnChatStatus(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: returnChatStatus\n")
+	json.NewEncoder(w).Encode(currentChatStatus())
+}
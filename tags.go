@@ -0,0 +1,447 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// -------------=========== TAGS ENDPOINTS
+
+// STTag labels games across lists, e.g. "co-op" or "short". Tag names are
+// unique, ignoring case.
+type STTag struct {
+	Id    int64  `json:"id"`
+	Name  string `json:"name"`
+	Games int    `json:"games"`
+}
+
+// parseTagList splits a comma-separated list of tag names, as taken by the
+// tags and excludeTags query parameters.
+func parseTagList(param string) []string {
+	var tags []string
+	for _, tag := range strings.Split(param, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// tagClause turns tag filters into an SQL condition on the games table: a
+// game must have every one of tags and none of excludeTags.
+func tagClause(tags []string, excludeTags []string) ([]string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+
+	for _, tag := range tags {
+		clauses = append(clauses, `gameId IN (SELECT gt.gameId FROM game_tags gt
+			JOIN tags t ON t.tagId = gt.tagId WHERE t.tagName = ?)`)
+		args = append(args, tag)
+	}
+	if len(excludeTags) > 0 {
+		clauses = append(clauses, `gameId NOT IN (SELECT gt.gameId FROM game_tags gt
+			JOIN tags t ON t.tagId = gt.tagId WHERE t.tagName IN (`+placeholders(len(excludeTags))+`))`)
+		for _, tag := range excludeTags {
+			args = append(args, tag)
+		}
+	}
+
+	return clauses, args
+}
+
+// attachTags fills in the tags of each game. The caller must hold
+// dbAccessMutex.
+func attachTags(games []STGame) error {
+	if len(games) == 0 {
+		return nil
+	}
+
+	gameIds := make([]int64, len(games))
+	for x, game := range games {
+		gameIds[x] = game.Id
+	}
+
+	stmt := `
+		SELECT gt.gameId, t.tagName FROM game_tags gt
+		JOIN tags t ON t.tagId = gt.tagId
+		WHERE gt.gameId IN (` + placeholders(len(gameIds)) + `)
+		ORDER BY t.tagName COLLATE NOCASE
+	`
+
+	rows, err := db.Query(stmt, int64Args(gameIds)...)
+	if err != nil {
+		fmt.Printf("%q: during query %s\n", err, stmt)
+		return fmt.Errorf("Error during query: %q", err)
+	}
+	defer rows.Close()
+
+	tags := map[int64][]string{}
+	for rows.Next() {
+		var gameId int64
+		var tag string
+		if err := rows.Scan(&gameId, &tag); err != nil {
+			fmt.Printf("%q: during exec %s\n", err, stmt)
+		}
+		tags[gameId] = append(tags[gameId], tag)
+	}
+
+	if err = rows.Err(); err != nil {
+		fmt.Printf("%q: after exec %s\n", err, stmt)
+	}
+
+	for x := range games {
+		games[x].Tags = tags[games[x].Id]
+	}
+	return nil
+}
+
+// tagGame adds tags to a game, making any tags that don't exist yet. If
+// replace is set, the game's other tags are taken off. The caller must hold
+// dbAccessMutex.
+func tagGame(gameId int64, tags []string, replace bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tagGameTx(tx, gameId, tags, replace); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tagGameTx is tagGame as part of a bigger transaction.
+func tagGameTx(tx *sql.Tx, gameId int64, tags []string, replace bool) error {
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM games WHERE gameId = ?)`, gameId).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return &apiError{fmt.Sprintf("Game ID not found: %d", gameId), http.StatusNotFound}
+	}
+
+	if replace {
+		if _, err := tx.Exec(`DELETE FROM game_tags WHERE gameId = ?`, gameId); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO tags (tagName)
+			SELECT ? WHERE NOT EXISTS (SELECT 1 FROM tags WHERE tagName = ?)
+		`, tag, tag); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			INSERT OR IGNORE INTO game_tags (gameId, tagId)
+			SELECT ?, tagId FROM tags WHERE tagName = ?
+		`, gameId, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findTag looks up a tag by its ID or, failing that, its name. The caller must
+// hold dbAccessMutex.
+func findTag(idOrName string) (STTag, error) {
+	stmt := `
+		SELECT t.tagId, t.tagName, COUNT(gt.gameId) FROM tags t
+		LEFT JOIN game_tags gt ON gt.tagId = t.tagId
+		WHERE t.tagId = ? OR t.tagName = ?
+		GROUP BY t.tagId
+		ORDER BY t.tagId = ? DESC
+	`
+
+	var tag STTag
+	if err := db.QueryRow(stmt, idOrName, idOrName, idOrName).Scan(&tag.Id, &tag.Name, &tag.Games); err != nil {
+		if err == sql.ErrNoRows {
+			return tag, &apiError{fmt.Sprintf("Tag not found: %s", idOrName), http.StatusNotFound}
+		}
+		fmt.Printf("%q: during exec %s\n", err, stmt)
+		return tag, fmt.Errorf("Error during exec: %q", err)
+	}
+	return tag, nil
+}
+
+func returnAllTags(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: returnAllTags\n")
+
+	stmt := `
+		SELECT t.tagId, t.tagName, COUNT(gt.gameId) FROM tags t
+		LEFT JOIN game_tags gt ON gt.tagId = t.tagId
+		GROUP BY t.tagId
+		ORDER BY t.tagName COLLATE NOCASE
+	`
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	rows, err := db.Query(stmt)
+	if err != nil {
+		fmt.Printf("%q: during query %s\n", err, stmt)
+		outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tags := []STTag{}
+	for rows.Next() {
+		var tag STTag
+		if err := rows.Scan(&tag.Id, &tag.Name, &tag.Games); err != nil {
+			fmt.Printf("%q: during exec %s\n", err, stmt)
+		}
+		tags = append(tags, tag)
+	}
+
+	if err = rows.Err(); err != nil {
+		fmt.Printf("%q: after exec %s\n", err, stmt)
+	}
+
+	json.NewEncoder(w).Encode(tags)
+}
+
+func returnSingleTag(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: returnSingleTag\n")
+	vars := mux.Vars(r)
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	if tag, err := findTag(vars["tag"]); err != nil {
+		outputErr(w, err)
+	} else {
+		json.NewEncoder(w).Encode(tag)
+	}
+}
+
+func createNewTag(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: createNewTag\n")
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Invalid data: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	var tag STTag
+	if err := json.Unmarshal(reqBody, &tag); err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Could not parse JSON: %q", err), http.StatusBadRequest)
+		return
+	}
+	if tag.Name = strings.TrimSpace(tag.Name); tag.Name == "" {
+		outputApiError(w, "Tag name can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	stmt := `
+		INSERT INTO tags (tagName)
+		SELECT ? WHERE NOT EXISTS (SELECT 1 FROM tags WHERE tagName = ?)
+	`
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	result, err := db.Exec(stmt, tag.Name, tag.Name)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Error preparing query: %q", err), http.StatusInternalServerError)
+	} else if rowsAff, _ := result.RowsAffected(); rowsAff == 0 {
+		outputApiError(w, fmt.Sprintf("Tag already exists: %s", tag.Name), http.StatusConflict)
+	} else {
+		tag.Id, _ = result.LastInsertId()
+		tag.Games = 0
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(tag)
+	}
+}
+
+func updateTag(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: updateTag\n")
+	vars := mux.Vars(r)
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Invalid data: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	var tagUpdate STTag
+	if err := json.Unmarshal(reqBody, &tagUpdate); err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Could not parse JSON: %q", err), http.StatusBadRequest)
+		return
+	}
+	if tagUpdate.Name = strings.TrimSpace(tagUpdate.Name); tagUpdate.Name == "" {
+		outputApiError(w, "Tag name can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	stmt := `UPDATE tags SET tagName = ? WHERE tagId = ?`
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	tag, err := findTag(vars["tag"])
+	if err != nil {
+		outputErr(w, err)
+		return
+	}
+
+	if _, err := db.Exec(stmt, tagUpdate.Name, tag.Id); err != nil {
+		fmt.Printf("err: %v\n", err)
+		if strings.Contains(err.Error(), "UNIQUE") {
+			outputApiError(w, fmt.Sprintf("Tag already exists: %s", tagUpdate.Name), http.StatusConflict)
+		} else {
+			outputApiError(w, fmt.Sprintf("Error preparing query: %q", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	tag.Name = tagUpdate.Name
+	json.NewEncoder(w).Encode(tag)
+}
+
+func deleteTag(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: deleteTag\n")
+	vars := mux.Vars(r)
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	tag, err := findTag(vars["tag"])
+	if err != nil {
+		outputErr(w, err)
+		return
+	}
+
+	stmt := `
+		DELETE FROM game_tags WHERE tagId = ?;
+		DELETE FROM tags WHERE tagId = ?;
+	`
+
+	if _, err := db.Exec(stmt, tag.Id, tag.Id); err != nil {
+		fmt.Printf("%q: during query %s\n", err, stmt)
+		outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func returnGameTags(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: returnGameTags\n")
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Invalid ID: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	games := []STGame{{Id: int64(id)}}
+	if err := attachTags(games); err != nil {
+		outputApiError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tags := games[0].Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	json.NewEncoder(w).Encode(tags)
+}
+
+// changeGameTags handles both PUT, which replaces a game's tags, and POST,
+// which adds to them. Either takes a JSON array of tag names.
+func changeGameTags(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: changeGameTags\n")
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Invalid ID: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Invalid data: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	var tags []string
+	if err := json.Unmarshal(reqBody, &tags); err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputApiError(w, fmt.Sprintf("Could not parse JSON: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	if err := tagGame(int64(id), tags, r.Method == "PUT"); err != nil {
+		fmt.Printf("err: %v\n", err)
+		outputErr(w, err)
+		return
+	}
+
+	games := []STGame{{Id: int64(id)}}
+	if err := attachTags(games); err != nil {
+		outputApiError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tags = games[0].Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	json.NewEncoder(w).Encode(tags)
+}
+
+func removeGameTag(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Endpoint hit: removeGameTag\n")
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		outputApiError(w, fmt.Sprintf("Invalid ID: %q", err), http.StatusBadRequest)
+		return
+	}
+
+	dbAccessMutex.Lock()
+	defer dbAccessMutex.Unlock()
+
+	tag, err := findTag(vars["tag"])
+	if err != nil {
+		outputErr(w, err)
+		return
+	}
+
+	stmt := `DELETE FROM game_tags WHERE gameId = ? AND tagId = ?`
+
+	if result, err := db.Exec(stmt, id, tag.Id); err != nil {
+		fmt.Printf("%q: during query %s\n", err, stmt)
+		outputApiError(w, fmt.Sprintf("Error during query: %q", err), http.StatusInternalServerError)
+	} else if rowsAff, _ := result.RowsAffected(); rowsAff == 0 {
+		outputApiError(w, fmt.Sprintf("Game %d isn't tagged %s", id, tag.Name), http.StatusNotFound)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}